@@ -3,6 +3,10 @@ package main
 
 import "time"
 
+// AgeLocation is the timezone birthdays are counted in by AgeIn. It defaults
+// to UTC so that ages do not depend on the server's local zone.
+var AgeLocation = time.UTC
+
 // AgeAt gets the age of an entity at a certain time.
 func AgeAt(birthDate time.Time, now time.Time) int {
 	// Get the year number change since the player's birth.
@@ -18,8 +22,91 @@ func AgeAt(birthDate time.Time, now time.Time) int {
 }
 
 // Age is shorthand for AgeAt(birthDate, time.Now()), and carries the same usage and limitations.
+// The current time is taken in birthDate's location.
 func Age(birthDate time.Time) int {
-	return AgeAt(birthDate, time.Now())
+	return AgeAt(birthDate, time.Now().In(birthDate.Location()))
+}
+
+// AgeAtIn gets the age at a certain time, with both dates taken in loc.
+func AgeAtIn(birthDate time.Time, now time.Time, loc *time.Location) int {
+	return AgeAt(birthDate.In(loc), now.In(loc))
+}
+
+// AgeIn gets the current age of someone born at the given unix time, in AgeLocation.
+func AgeIn(birthDate int64) int {
+	return AgeAtIn(time.Unix(birthDate, 0), time.Now(), AgeLocation)
+}
+
+// AgeDetailAt gets the age at a certain time as whole years, months and days.
+// Years agree with AgeAt, months and days count from the last birthday.
+// Dates are compared as calendar days, each in its own location.
+func AgeDetailAt(birthDate time.Time, now time.Time) (years, months, days int) {
+	years = AgeAt(birthDate, now)
+	today := calendarDate(now)
+
+	anniversary := birthdayIn(birthDate, birthDate.Year()+years)
+	for !addMonths(anniversary, birthDate.Day(), months+1).After(today) {
+		months++
+	}
+
+	days = int(today.Sub(addMonths(anniversary, birthDate.Day(), months)).Hours() / 24)
+	return years, months, days
+}
+
+// NextBirthdayAt gets the date of the next birthday on or after now, as
+// midnight in now's location. Feb 29 birthdays fall on Feb 28 in common
+// years, as in AgeAt.
+func NextBirthdayAt(birthDate time.Time, now time.Time) time.Time {
+	today := calendarDate(now)
+
+	next := birthdayIn(birthDate, now.Year())
+	if next.Before(today) {
+		next = birthdayIn(birthDate, now.Year()+1)
+	}
+	return time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// Gets the calendar date of t as a UTC midnight, so day arithmetic is DST-free.
+func calendarDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Gets the birthday in the given year as a calendar date.
+func birthdayIn(birthDate time.Time, year int) time.Time {
+	return addMonths(time.Date(year, birthDate.Month(), 1, 0, 0, 0, 0, time.UTC), birthDate.Day(), 0)
+}
+
+// Adds months to a calendar date, clamping to day or the month's last day.
+func addMonths(date time.Time, day int, months int) time.Time {
+	first := time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+// LatestBirthAt returns the last unix second someone may be born at and still
+// be at least age years old at now, according to AgeAt. Since AgeAt only looks
+// at calendar days, it is the end of a day in now's location.
+func LatestBirthAt(age int, now time.Time) int64 {
+	loc := now.Location()
+	year := now.Year() - age
+
+	days := 365
+	if isLeap(time.Date(year, 1, 1, 0, 0, 0, 0, loc)) {
+		days = 366
+	}
+
+	// The adjusted birthday never decreases through the year, so the first
+	// day from the end that is old enough closes the range.
+	for day := days; day >= 1; day-- {
+		birth := time.Date(year, 1, day, 0, 0, 0, 0, loc)
+		if AgeAt(birth, now) >= age {
+			return birth.AddDate(0, 0, 1).Unix() - 1
+		}
+	}
+	return time.Date(year, 1, 1, 0, 0, 0, 0, loc).Unix() - 1
 }
 
 // Gets the adjusted date of birth to work around leap year differences.
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The fromAge/toAge filters compare birth dates against LatestBirthAt instead
+// of computing every visitor's age, the answers have to be the same.
+func TestLatestBirthAtLeapDay(t *testing.T) {
+	vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+
+	var nows []time.Time
+	for _, loc := range []*time.Location{time.UTC, vladivostok} {
+		// 2019 is a common year, 2020 a leap one. Feb 29 2019 does not exist.
+		for _, d := range [][3]int{{2019, 2, 28}, {2019, 3, 1}, {2020, 2, 28}, {2020, 2, 29}, {2020, 3, 1}} {
+			for _, hour := range []int{0, 12, 23} {
+				nows = append(nows, time.Date(d[0], time.Month(d[1]), d[2], hour, 30, 0, 0, loc))
+			}
+		}
+	}
+
+	for _, now := range nows {
+		for _, birthYear := range []int{1960, 1996, 2000, 2004, 2016} {
+			for _, hour := range []int{0, 12, 23} {
+				birth := time.Date(birthYear, 2, 29, hour, 59, 59, 0, now.Location())
+				if birth.Month() != time.February {
+					t.Fatalf("%d is not a leap year", birthYear)
+				}
+
+				u := User{BirthDate: birth.Unix()}
+				for age := 0; age <= now.Year()-birthYear+1; age++ {
+					got := u.BirthDate <= LatestBirthAt(age, now)
+					want := AgeAtIn(birth, now, now.Location()) >= age
+					if got != want {
+						t.Errorf("born %s, now %s, age %d: cutoff says %v, AgeAtIn says %v",
+							birth, now, age, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// The same through LocationVisitsFilter, at the edges of the range.
+func TestLocationVisitsFilterAgeLeapDay(t *testing.T) {
+	now := time.Date(2019, 2, 28, 12, 0, 0, 0, time.UTC)
+	f := LocationVisitsFilter{
+		HasFromAge: true, FromAge: 19, MaxBirthDate: LatestBirthAt(19, now),
+		HasToAge: true, ToAge: 20, MinBirthDate: LatestBirthAt(20, now),
+	}
+
+	cases := []struct {
+		birth time.Time
+		match bool
+	}{
+		{time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), true},     // 19 on Feb 28 of a common year
+		{time.Date(2000, 3, 1, 0, 0, 0, 0, time.UTC), false},     // still 18
+		{time.Date(1999, 2, 28, 23, 59, 59, 0, time.UTC), false}, // 20 today
+		{time.Date(1999, 3, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, c := range cases {
+		u := User{BirthDate: c.birth.Unix()}
+		if got := f.Match(&Visit{}, &u); got != c.match {
+			t.Errorf("born %s: match %v, want %v", c.birth, got, c.match)
+		}
+	}
+}
+
+func TestAgeAtIn(t *testing.T) {
+	vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+
+	utc := func(y, m, d, hour int) time.Time {
+		return time.Date(y, time.Month(m), d, hour, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name  string
+		birth time.Time
+		now   time.Time
+		loc   *time.Location
+		age   int
+	}{
+		{"feb 29, feb 28 of common year", utc(1996, 2, 29, 12), utc(2017, 2, 28, 12), time.UTC, 21},
+		{"feb 29, feb 27 of common year", utc(1996, 2, 29, 12), utc(2017, 2, 27, 12), time.UTC, 20},
+		{"feb 29, feb 28 of leap year", utc(1996, 2, 29, 12), utc(2020, 2, 28, 12), time.UTC, 23},
+		{"feb 29, feb 29 of leap year", utc(1996, 2, 29, 12), utc(2020, 2, 29, 12), time.UTC, 24},
+		{"dec 31, dec 31", utc(1990, 12, 31, 12), utc(2017, 12, 31, 12), time.UTC, 27},
+		{"dec 31, jan 1", utc(1990, 12, 31, 12), utc(2018, 1, 1, 12), time.UTC, 27},
+		{"jan 1, dec 31", utc(1991, 1, 1, 12), utc(2017, 12, 31, 12), time.UTC, 26},
+		{"jan 1, jan 1", utc(1991, 1, 1, 12), utc(2018, 1, 1, 12), time.UTC, 27},
+		{"before 1970, day before", time.Unix(-100000000, 0), utc(2017, 10, 30, 12), time.UTC, 50},
+		{"before 1970, birthday", time.Unix(-100000000, 0), utc(2017, 10, 31, 12), time.UTC, 51},
+		{"before 1970, feb 29", utc(1960, 2, 29, 0), utc(2017, 2, 28, 0), time.UTC, 57},
+		// 1999-12-31 20:00 UTC is already 2000-01-01 in Vladivostok, so on
+		// 2018-12-31 20:00 there (10:00 UTC) the birthday has only come in UTC.
+		{"new year, utc", utc(1999, 12, 31, 20), utc(2018, 12, 31, 10), time.UTC, 19},
+		{"new year, vladivostok", utc(1999, 12, 31, 20), utc(2018, 12, 31, 10), vladivostok, 18},
+		// 2017-06-12 20:00 UTC is already the birthday, June 13, in Vladivostok
+		{"birthday not yet in utc", utc(1999, 6, 13, 10), utc(2017, 6, 12, 20), time.UTC, 17},
+		{"birthday in vladivostok", utc(1999, 6, 13, 10), utc(2017, 6, 12, 20), vladivostok, 18},
+	}
+
+	for _, c := range cases {
+		if got := AgeAtIn(c.birth, c.now, c.loc); got != c.age {
+			t.Errorf("%s: AgeAtIn(%s, %s, %s) = %d, want %d", c.name, c.birth, c.now, c.loc, got, c.age)
+		}
+	}
+}
+
+func TestAgeIn(t *testing.T) {
+	defer func(loc *time.Location) { AgeLocation = loc }(AgeLocation)
+
+	vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+
+	for _, loc := range []*time.Location{time.UTC, vladivostok} {
+		AgeLocation = loc
+		now := time.Now().In(loc)
+		if now.Month() == time.February && now.Day() == 29 {
+			t.Skip("the birthday 30 years ago does not exist today")
+		}
+
+		// Midnight today, 30 years ago, and the day after
+		birth := time.Date(now.Year()-30, now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		if got := AgeIn(birth.Unix()); got != 30 {
+			t.Errorf("%s: AgeIn(%s) = %d, want 30", loc, birth, got)
+		}
+		if got := AgeIn(birth.AddDate(0, 0, 1).Unix()); got != 29 {
+			t.Errorf("%s: AgeIn(%s) = %d, want 29", loc, birth.AddDate(0, 0, 1), got)
+		}
+		if got := AgeIn(time.Date(1950, 1, 1, 0, 0, 0, 0, loc).Unix()); got != now.Year()-1950 {
+			t.Errorf("%s: AgeIn(1950-01-01) = %d, want %d", loc, got, now.Year()-1950)
+		}
+	}
+}
+
+func TestAddMonths(t *testing.T) {
+	date := func(y, m, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		date   time.Time
+		day    int
+		months int
+		want   time.Time
+	}{
+		{date(2020, 1, 31), 31, 1, date(2020, 2, 29)},
+		{date(2019, 1, 31), 31, 1, date(2019, 2, 28)},
+		{date(2019, 8, 31), 31, 1, date(2019, 9, 30)},
+		{date(2019, 8, 31), 31, 6, date(2020, 2, 29)},
+		{date(2019, 8, 31), 31, 7, date(2020, 3, 31)},
+		{date(2020, 2, 29), 31, 1, date(2020, 3, 31)}, // day survives an earlier clamp
+		{date(2020, 3, 31), 31, -1, date(2020, 2, 29)},
+		{date(2019, 12, 15), 15, 1, date(2020, 1, 15)},
+		{date(2019, 2, 1), 29, 0, date(2019, 2, 28)},
+	}
+
+	for _, c := range cases {
+		if got := addMonths(c.date, c.day, c.months); !got.Equal(c.want) {
+			t.Errorf("addMonths(%s, %d, %d) = %s, want %s", c.date.Format("2006-01-02"), c.day, c.months,
+				got.Format("2006-01-02"), c.want.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestAgeDetailAt(t *testing.T) {
+	utc := func(y, m, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 12, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name                string
+		birth               time.Time
+		now                 time.Time
+		years, months, days int
+	}{
+		{"jan 31, feb 29", utc(1990, 1, 31), utc(2020, 2, 29), 30, 1, 0},
+		{"jan 31, feb 28 of leap year", utc(1990, 1, 31), utc(2020, 2, 28), 30, 0, 28},
+		{"jan 31, feb 28 of common year", utc(1990, 1, 31), utc(2019, 2, 28), 29, 1, 0},
+		{"aug 31, mar 30", utc(1990, 8, 31), utc(2020, 3, 30), 29, 6, 30},
+		{"aug 31, mar 31", utc(1990, 8, 31), utc(2020, 3, 31), 29, 7, 0},
+		{"feb 29, feb 28 of common year", utc(1996, 2, 29), utc(2017, 2, 28), 21, 0, 0},
+		{"feb 29, feb 27 of common year", utc(1996, 2, 29), utc(2017, 2, 27), 20, 11, 29},
+		{"feb 29, mar 28 of common year", utc(1996, 2, 29), utc(2017, 3, 28), 21, 0, 28},
+		{"feb 29, feb 29", utc(1996, 2, 29), utc(2020, 2, 29), 24, 0, 0},
+		{"birthday", utc(1990, 6, 13), utc(2017, 6, 13), 27, 0, 0},
+		{"day before birthday", utc(1990, 6, 13), utc(2017, 6, 12), 26, 11, 30},
+	}
+
+	for _, c := range cases {
+		years, months, days := AgeDetailAt(c.birth, c.now)
+		if years != c.years || months != c.months || days != c.days {
+			t.Errorf("%s: AgeDetailAt = %d years %d months %d days, want %d %d %d",
+				c.name, years, months, days, c.years, c.months, c.days)
+		}
+	}
+}
+
+func TestNextBirthdayAt(t *testing.T) {
+	vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+
+	utc := func(y, m, d, hour int) time.Time {
+		return time.Date(y, time.Month(m), d, hour, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name  string
+		birth time.Time
+		now   time.Time
+		want  time.Time
+	}{
+		{"feb 29, common year", utc(1996, 2, 29, 0), utc(2017, 1, 10, 12), utc(2017, 2, 28, 0)},
+		{"feb 29, on feb 28", utc(1996, 2, 29, 0), utc(2017, 2, 28, 12), utc(2017, 2, 28, 0)},
+		{"feb 29, after feb 28", utc(1996, 2, 29, 0), utc(2017, 3, 1, 12), utc(2018, 2, 28, 0)},
+		{"feb 29, leap year next", utc(1996, 2, 29, 0), utc(2019, 3, 1, 12), utc(2020, 2, 29, 0)},
+		{"dec 31, on the day", utc(1990, 12, 31, 0), utc(2017, 12, 31, 23), utc(2017, 12, 31, 0)},
+		{"dec 31, jan 1", utc(1990, 12, 31, 0), utc(2018, 1, 1, 0), utc(2018, 12, 31, 0)},
+		{"jan 1, dec 31", utc(1990, 1, 1, 0), utc(2017, 12, 31, 12), utc(2018, 1, 1, 0)},
+		// 2017-06-12 20:00 UTC is June 13 in Vladivostok, midnight there
+		{"vladivostok", utc(1999, 6, 13, 10), utc(2017, 6, 12, 20).In(vladivostok),
+			time.Date(2017, 6, 13, 0, 0, 0, 0, vladivostok)},
+	}
+
+	for _, c := range cases {
+		if got := NextBirthdayAt(c.birth, c.now); !got.Equal(c.want) || got.Location() != c.now.Location() {
+			t.Errorf("%s: NextBirthdayAt(%s, %s) = %s, want %s", c.name, c.birth, c.now, got, c.want)
+		}
+	}
+}
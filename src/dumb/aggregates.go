@@ -0,0 +1,367 @@
+package main
+
+import (
+  "log"
+  "sort"
+  "sync"
+  "sync/atomic"
+  "time"
+  "github.com/valyala/fasthttp"
+  "golang.org/x/text/unicode/norm"
+)
+
+// Running mark totals per location, kept in step with hlVisitsByLoc by
+// VisitsHandlerPOST and UsersHandlerPOST, and rebuilt once the data archive
+// is loaded. Besides the location total they are split by gender, by the
+// visitor's birth year and by the month of the visit (UTC), so unfiltered,
+// gender-only and age-only requests never walk the visits of a location, and
+// date ranges only walk the visits of the months they cut through.
+
+type MarkTotals struct {
+  Sum        int
+  Count      int
+}
+
+func (t *MarkTotals) add(mark int, sign int) {
+  t.Sum += sign * mark
+  t.Count += sign
+}
+
+type VisitBucket struct {
+  Totals     MarkTotals
+  Visits     []int
+}
+
+type LocationAggregate struct {
+  Totals     MarkTotals
+  Male       MarkTotals
+  Female     MarkTotals
+  ByBirthYear map[int]*VisitBucket
+  ByMonth    map[int]*VisitBucket
+}
+
+// bucketApply adds or removes visit v in buckets[key]
+func bucketApply(buckets map[int]*VisitBucket, key int, v *Visit, sign int) {
+  bucket, ok := buckets[key]
+  if !ok {
+    bucket = &VisitBucket{}
+    buckets[key] = bucket
+  }
+  bucket.Totals.add(*v.Mark, sign)
+
+  if sign > 0 {
+    bucket.Visits = append(bucket.Visits, v.ID)
+  } else {
+    for i, vID := range bucket.Visits {
+      if vID == v.ID {
+        bucket.Visits[i] = bucket.Visits[len(bucket.Visits)-1]
+        bucket.Visits = bucket.Visits[:len(bucket.Visits)-1]
+        break
+      }
+    }
+  }
+}
+
+var hlLocationAggs = make(map[int]*LocationAggregate)
+var hlLocationAggsMutex sync.Mutex
+
+// Set by RebuildLocationAggs, until then locationMarks scans the visits
+var hlLocationAggsReady int32
+
+func birthYear(u *User) int {
+  return time.Unix(u.BirthDate, 0).In(AgeLocation).Year()
+}
+
+// visitMonth numbers months from year 0, in UTC
+func visitMonth(v *Visit) int {
+  t := time.Unix(v.VisitedAt, 0).UTC()
+  return t.Year() * 12 + int(t.Month()) - 1
+}
+
+// monthBounds returns the first and the last second of month
+func monthBounds(month int) (int64, int64) {
+  first := time.Date(month / 12, time.Month(month % 12 + 1), 1, 0, 0, 0, 0, time.UTC)
+  return first.Unix(), first.AddDate(0, 1, 0).Unix() - 1
+}
+
+// locationAggApply adds (sign 1) or removes (sign -1) visit v made by user u
+// from the aggregate of the visit's current location.
+func locationAggApply(v *Visit, u *User, sign int) {
+  hlLocationAggsMutex.Lock()
+  locationAggApplyLocked(v, u, sign)
+  hlLocationAggsMutex.Unlock()
+}
+
+func locationAggApplyLocked(v *Visit, u *User, sign int) {
+  agg, ok := hlLocationAggs[v.Location]
+  if !ok {
+    agg = &LocationAggregate{ByBirthYear: make(map[int]*VisitBucket), ByMonth: make(map[int]*VisitBucket)}
+    hlLocationAggs[v.Location] = agg
+  }
+
+  mark := *v.Mark
+  agg.Totals.add(mark, sign)
+
+  if u.Gender == "m" {
+    agg.Male.add(mark, sign)
+  } else if u.Gender == "f" {
+    agg.Female.add(mark, sign)
+  }
+
+  bucketApply(agg.ByBirthYear, birthYear(u), v, sign)
+  bucketApply(agg.ByMonth, visitMonth(v), v, sign)
+}
+
+// RebuildLocationAggs recomputes all aggregates from hlVisitsData. The loaders
+// run concurrently, so this is done once users and visits are all in. The
+// server is already up by then: visit and user POSTs apply their changes to
+// the aggregates under hlVisitsMutex, so holding it here counts each visit
+// exactly once.
+func RebuildLocationAggs() {
+  start := time.Now()
+
+  hlUsersMutex.Lock()
+  hlVisitsMutex.Lock()
+  hlLocationAggsMutex.Lock()
+  hlLocationAggs = make(map[int]*LocationAggregate)
+  for _, v := range hlVisitsData {
+    u := hlUsersData[v.User]
+    locationAggApplyLocked(v, &u, 1)
+  }
+  atomic.StoreInt32(&hlLocationAggsReady, 1)
+  hlLocationAggsMutex.Unlock()
+  hlVisitsMutex.Unlock()
+  hlUsersMutex.Unlock()
+
+  log.Printf("RebuildLocationAggs took %s", time.Since(start))
+}
+
+// locationMarks returns the mark total and count for one location matching
+// filter. Age combined with gender scans the visits, as does everything
+// before the aggregates are first built.
+//
+// hlLocationAggsMutex is held for the whole read: POSTs add buckets to
+// ByBirthYear and ByMonth and change their Visits while we range over them.
+func locationMarks(lid int, filter *LocationVisitsFilter) (int, int) {
+  if atomic.LoadInt32(&hlLocationAggsReady) == 0 {
+    return scanLocationMarks(hlVisitsByLoc[lid], filter)
+  }
+
+  hlLocationAggsMutex.Lock()
+  defer hlLocationAggsMutex.Unlock()
+
+  agg, ok := hlLocationAggs[lid]
+  if !ok {
+    return 0, 0
+  }
+
+  if filter.HasFromDate || filter.HasToDate {
+    return dateLocationMarks(agg, filter)
+  }
+
+  if filter.HasFromAge || filter.HasToAge {
+    if filter.HasGender {
+      return scanLocationMarks(hlVisitsByLoc[lid], filter)
+    }
+    return ageLocationMarks(agg, filter)
+  }
+
+  if filter.HasGender {
+    if filter.Gender == "m" {
+      return agg.Male.Sum, agg.Male.Count
+    }
+    return agg.Female.Sum, agg.Female.Count
+  }
+
+  return agg.Totals.Sum, agg.Totals.Count
+}
+
+func scanLocationMarks(visitIDs []int, filter *LocationVisitsFilter) (int, int) {
+  total, cnt := 0, 0
+  for _, vID := range visitIDs {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if filter.Match(v, &u) {
+      total += *v.Mark
+      cnt += 1
+    }
+  }
+  return total, cnt
+}
+
+// ageLocationMarks sums the birth-year buckets lying wholly inside the
+// filter's birth date bounds, and scans visit by visit only the boundary
+// years the bounds cut through.
+func ageLocationMarks(agg *LocationAggregate, filter *LocationVisitsFilter) (int, int) {
+  total, cnt := 0, 0
+
+  for year, bucket := range agg.ByBirthYear {
+    first := time.Date(year, 1, 1, 0, 0, 0, 0, AgeLocation).Unix()
+    last := time.Date(year + 1, 1, 1, 0, 0, 0, 0, AgeLocation).Unix() - 1
+
+    all, none := true, false
+    if filter.HasFromAge {
+      all = all && last <= filter.MaxBirthDate
+      none = none || first > filter.MaxBirthDate
+    }
+    if filter.HasToAge {
+      all = all && first > filter.MinBirthDate
+      none = none || last <= filter.MinBirthDate
+    }
+
+    if all {
+      total += bucket.Totals.Sum
+      cnt += bucket.Totals.Count
+    } else if !none {
+      t, c := scanLocationMarks(bucket.Visits, filter)
+      total += t
+      cnt += c
+    }
+  }
+  return total, cnt
+}
+
+// dateLocationMarks sums the months lying wholly inside the filter's date
+// range, and scans visit by visit the months the range cuts through. With
+// other filters too, every month in range is scanned.
+func dateLocationMarks(agg *LocationAggregate, filter *LocationVisitsFilter) (int, int) {
+  total, cnt := 0, 0
+  others := filter.HasFromAge || filter.HasToAge || filter.HasGender
+
+  for month, bucket := range agg.ByMonth {
+    first, last := monthBounds(month)
+
+    all, none := true, false
+    if filter.HasFromDate {
+      all = all && first > filter.FromDate
+      none = none || last <= filter.FromDate
+    }
+    if filter.HasToDate {
+      all = all && last < filter.ToDate
+      none = none || first >= filter.ToDate
+    }
+
+    if all && !others {
+      total += bucket.Totals.Sum
+      cnt += bucket.Totals.Count
+    } else if !none {
+      t, c := scanLocationMarks(bucket.Visits, filter)
+      total += t
+      cnt += c
+    }
+  }
+  return total, cnt
+}
+
+type TopLocationOut struct {
+  ID         int      `json:"id"`
+  Place      string   `json:"place"`
+  City       string   `json:"city"`
+  Country    string   `json:"country"`
+  Avg        float64  `json:"avg"`
+  Count      int      `json:"count"`
+}
+
+type TopLocationsType []TopLocationOut
+
+type TopLocationsOut struct {
+  Locations  []TopLocationOut `json:"locations"`
+}
+
+// Sorted best first by avg or count, ties by id
+type TopLocationsSorter struct {
+  Locations  TopLocationsType
+  ByCount    bool
+}
+
+func (s TopLocationsSorter) Len() int {
+  return len(s.Locations)
+}
+
+func (s TopLocationsSorter) Swap(i, j int) {
+  s.Locations[i], s.Locations[j] = s.Locations[j], s.Locations[i]
+}
+
+func (s TopLocationsSorter) Less(i, j int) bool {
+  a, b := &s.Locations[i], &s.Locations[j]
+
+  if s.ByCount {
+    if a.Count != b.Count {
+      return a.Count > b.Count
+    }
+  } else if a.Avg != b.Avg {
+    return a.Avg > b.Avg
+  }
+
+  return a.ID < b.ID
+}
+
+const defaultTopLimit = 10
+
+// LocationsHandlerGETTop ranks locations by metric=avg|count, from the running
+// aggregates through locationMarks. fromDate/toDate ("most visited this
+// month") only scan the visits of the months at the range's ends.
+func LocationsHandlerGETTop(ctx *fasthttp.RequestCtx) (int, []byte) {
+  params := ctx.QueryArgs()
+
+  byCount := false
+  if params.Has("metric") {
+    metric := string(params.Peek("metric"))
+    if metric == "count" {
+      byCount = true
+    } else if metric != "avg" {
+      return errorResponse(400, badParam("metric"))
+    }
+  }
+
+  filter, apiErr := ParseLocationVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  minCount, _, ok := queryInt(params, "minCount", true)
+  if !ok || minCount < 0 {
+    return errorResponse(400, badParam("minCount"))
+  }
+
+  limit, hasLimit, ok := queryInt(params, "limit", false)
+  if !ok || limit < 0 {
+    return errorResponse(400, badParam("limit"))
+  }
+  if !hasLimit {
+    limit = defaultTopLimit
+  }
+
+  hasCountry, country := params.Has("country"), norm.NFC.String(string(params.Peek("country")))
+  hasCity, city := params.Has("city"), norm.NFC.String(string(params.Peek("city")))
+
+  top := make([]TopLocationOut, 0)
+
+  hlLocationsMutex.Lock()
+  for lid, l := range hlLocationsData {
+    if hasCountry && l.Country != country {
+      continue
+    }
+    if hasCity && l.City != city {
+      continue
+    }
+
+    total, cnt := locationMarks(lid, &filter)
+
+    if cnt == 0 || cnt < minCount {
+      continue
+    }
+
+    top = append(top, TopLocationOut{lid, l.Place, l.City, l.Country, round5(float64(total) / float64(cnt)), cnt})
+  }
+  hlLocationsMutex.Unlock()
+
+  sort.Sort(TopLocationsSorter{top, byCount})
+
+  if len(top) > limit {
+    top = top[:limit]
+  }
+
+  return 200, []byte(toJson(TopLocationsOut{top}))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "math/rand"
+  "net/url"
+  "reflect"
+  "sync/atomic"
+  "testing"
+  "time"
+  "github.com/valyala/fasthttp"
+)
+
+// resetTestData empties the in-memory store and the location aggregates.
+func resetTestData() {
+  hlUsersData = make(map[int]User)
+  hlUsersEmails = make(map[string]int)
+  hlLocationsData = make(map[int]Location)
+  hlVisitsData = make(map[int]*Visit)
+  hlVisitsByUser = make(map[int][]int)
+  hlVisitsByLoc = make(map[int][]int)
+  hlLocationAggs = make(map[int]*LocationAggregate)
+  atomic.StoreInt32(&hlLocationAggsReady, 0)
+}
+
+func testPOST(h func(ctx *fasthttp.RequestCtx, id int) (int, []byte), id int, body string) (int, []byte) {
+  var ctx fasthttp.RequestCtx
+  ctx.Request.Header.SetMethod("POST")
+  ctx.Request.SetBodyString(body)
+  return h(&ctx, id)
+}
+
+// The aggregates have to answer like a scan of the location's visits after
+// any sequence of visit and user updates.
+func TestLocationMarksMatchScan(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  rnd := rand.New(rand.NewSource(1))
+  base := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+  genders := []string{"m", "f"}
+
+  const users, locations, visits = 20, 5, 200
+
+  for i := 1; i <= users; i++ {
+    birth := time.Date(1950 + rnd.Intn(55), time.Month(1 + rnd.Intn(12)), 1 + rnd.Intn(28), 0, 0, 0, 0, time.UTC)
+    hlUsersData[i] = User{ID: i, Email: fmt.Sprintf("u%d@mail.ru", i), FirstName: "Иван", LastName: "Петров",
+      Gender: genders[rnd.Intn(2)], BirthDate: birth.Unix()}
+  }
+  for i := 1; i <= locations; i++ {
+    hlLocationsData[i] = Location{ID: i, Place: "Парк", Country: "Россия", City: "Москва", Distance: i}
+  }
+  for i := 1; i <= visits; i++ {
+    mark := rnd.Intn(6)
+    v := &Visit{ID: i, User: 1 + rnd.Intn(users), Location: 1 + rnd.Intn(locations),
+      VisitedAt: base + rnd.Int63n(3 * 365 * 86400), Mark: &mark}
+    hlVisitsData[i] = v
+    hlVisitsByUser[v.User] = append(hlVisitsByUser[v.User], i)
+    hlVisitsByLoc[v.Location] = append(hlVisitsByLoc[v.Location], i)
+  }
+
+  RebuildLocationAggs()
+
+  queries := []string{
+    "",
+    "gender=m",
+    "gender=f",
+    "fromAge=30",
+    "toAge=45",
+    "fromAge=25&toAge=50",
+    "fromAge=30&gender=f",
+    fmt.Sprintf("fromDate=%d", base + 400 * 86400 + 12345),
+    fmt.Sprintf("toDate=%d", base + 700 * 86400 + 777),
+    fmt.Sprintf("fromDate=%d&toDate=%d", base + 100 * 86400 + 1, base + 900 * 86400 - 1),
+    fmt.Sprintf("fromDate=%d&toDate=%d&gender=m&fromAge=20", base + 50 * 86400, base + 1000 * 86400),
+  }
+
+  check := func(step string) {
+    for _, q := range queries {
+      var args fasthttp.Args
+      args.Parse(q)
+      filter, apiErr := ParseLocationVisitsFilter(&args)
+      if apiErr != nil {
+        t.Fatalf("%s: %v", q, apiErr)
+      }
+
+      for lid := 1; lid <= locations; lid++ {
+        total, cnt := locationMarks(lid, &filter)
+        wantTotal, wantCnt := scanLocationMarks(hlVisitsByLoc[lid], &filter)
+        if total != wantTotal || cnt != wantCnt {
+          t.Fatalf("after %s, location %d, %q: %d/%d, scan gives %d/%d", step, lid, q, total, cnt, wantTotal, wantCnt)
+        }
+      }
+    }
+  }
+
+  check("rebuild")
+
+  for step := 0; step < 300; step++ {
+    var body, what string
+    var status int
+
+    switch rnd.Intn(5) {
+    case 0:
+      what = "visit location"
+      body = fmt.Sprintf(`{"location": %d}`, 1 + rnd.Intn(locations))
+      status, _ = testPOST(VisitsHandlerPOST, 1 + rnd.Intn(visits), body)
+    case 1:
+      what = "visit mark and date"
+      body = fmt.Sprintf(`{"mark": %d, "visited_at": %d}`, rnd.Intn(6), base + rnd.Int63n(3 * 365 * 86400))
+      status, _ = testPOST(VisitsHandlerPOST, 1 + rnd.Intn(visits), body)
+    case 2:
+      what = "visit user"
+      body = fmt.Sprintf(`{"user": %d}`, 1 + rnd.Intn(users))
+      status, _ = testPOST(VisitsHandlerPOST, 1 + rnd.Intn(visits), body)
+    case 3:
+      what = "user gender"
+      body = fmt.Sprintf(`{"gender": "%s"}`, genders[rnd.Intn(2)])
+      status, _ = testPOST(UsersHandlerPOST, 1 + rnd.Intn(users), body)
+    case 4:
+      what = "user birth_date"
+      birth := time.Date(1950 + rnd.Intn(55), time.Month(1 + rnd.Intn(12)), 1 + rnd.Intn(28), 0, 0, 0, 0, time.UTC)
+      body = fmt.Sprintf(`{"birth_date": %d}`, birth.Unix())
+      status, _ = testPOST(UsersHandlerPOST, 1 + rnd.Intn(users), body)
+    }
+
+    if status != 200 {
+      t.Fatalf("%s %s: status %d", what, body, status)
+    }
+    check(what + " " + body)
+  }
+}
+
+func TestLocationsHandlerGETTop(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  // Marks per location, 5 has no visits
+  marks := map[int][]int{
+    1: {5, 5},
+    2: {5},
+    3: {4, 4, 4},
+    4: {4, 4, 4},
+    5: {},
+  }
+  for lid := 6; lid <= 15; lid++ {
+    marks[lid] = []int{1}
+  }
+
+  hlUsersData[1] = User{ID: 1, Gender: "f"}
+  vID := 0
+  for lid, ms := range marks {
+    l := Location{ID: lid, Place: "Парк", Country: "Германия", City: "Берлин"}
+    switch lid {
+    case 1, 2, 3:
+      l.Country, l.City = "Россия", "Москва"
+    case 4:
+      l.Country, l.City = "Россия", "Йошкар-Ола" // stored NFC
+    }
+    hlLocationsData[lid] = l
+
+    for _, m := range ms {
+      m := m
+      vID += 1
+      hlVisitsData[vID] = &Visit{ID: vID, User: 1, Location: lid, VisitedAt: 1000000000, Mark: &m}
+      hlVisitsByUser[1] = append(hlVisitsByUser[1], vID)
+      hlVisitsByLoc[lid] = append(hlVisitsByLoc[lid], vID)
+    }
+  }
+
+  RebuildLocationAggs()
+
+  cases := []struct {
+    query  string
+    status int
+    ids    []int
+  }{
+    // Best avg first, ties by id, 10 by default
+    {"", 200, []int{1, 2, 3, 4, 6, 7, 8, 9, 10, 11}},
+    {"metric=avg", 200, []int{1, 2, 3, 4, 6, 7, 8, 9, 10, 11}},
+    {"metric=count", 200, []int{3, 4, 1, 2, 6, 7, 8, 9, 10, 11}},
+    {"limit=3", 200, []int{1, 2, 3}},
+    {"limit=20", 200, []int{1, 2, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+    {"minCount=2", 200, []int{1, 3, 4}},
+    {"metric=count&minCount=3", 200, []int{3, 4}},
+    {"minCount=4", 200, []int{}},
+    {"country=" + url.QueryEscape("Россия"), 200, []int{1, 2, 3, 4}},
+    {"country=" + url.QueryEscape("Россия") + "&city=" + url.QueryEscape("Москва") + "&metric=count", 200, []int{3, 1, 2}},
+    // и with a combining breve matches the stored й
+    {"city=" + url.QueryEscape("И\u0306ошкар-Ола"), 200, []int{4}},
+    {"city=" + url.QueryEscape("Париж"), 200, []int{}},
+
+    {"metric=rating", 400, nil},
+    {"limit=0", 400, nil},
+    {"limit=-1", 400, nil},
+    {"minCount=-1", 400, nil},
+    {"gender=x", 400, nil},
+  }
+
+  for _, c := range cases {
+    var ctx fasthttp.RequestCtx
+    ctx.Request.Header.SetMethod("GET")
+    ctx.Request.SetRequestURI("/locations/top?" + c.query)
+
+    status, body := LocationsHandlerGETTop(&ctx)
+    if status != c.status {
+      t.Errorf("%q: status %d, want %d", c.query, status, c.status)
+      continue
+    }
+    if status != 200 {
+      continue
+    }
+
+    var out TopLocationsOut
+    if err := json.Unmarshal(body, &out); err != nil {
+      t.Fatalf("%q: %s", c.query, err)
+    }
+    ids := []int{}
+    for _, l := range out.Locations {
+      ids = append(ids, l.ID)
+    }
+    if !reflect.DeepEqual(ids, c.ids) {
+      t.Errorf("%q: %v, want %v", c.query, ids, c.ids)
+    }
+  }
+
+  // The items themselves
+  var ctx fasthttp.RequestCtx
+  ctx.Request.SetRequestURI("/locations/top?limit=1&metric=count")
+  _, body := LocationsHandlerGETTop(&ctx)
+  want := `{"locations":[{"id":3,"place":"Парк","city":"Москва","country":"Россия","avg":4,"count":3}]}`
+  if string(body) != want {
+    t.Errorf("%s, want %s", body, want)
+  }
+}
@@ -7,6 +7,11 @@ import (
 	"net/smtp"
 	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
 )
 
 type SmtpError struct {
@@ -30,34 +35,150 @@ func NewSmtpError(err error) SmtpError {
 var (
 	ErrBadFormat        = errors.New("invalid format")
 	ErrUnresolvableHost = errors.New("unresolvable host")
+	ErrDNSTemporary     = errors.New("temporary DNS failure")
 
-	emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	// RFC 6531: the ASCII atext characters plus any non-ASCII UTF-8
+	localPartRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~\\x{80}-\\x{10FFFF}-]+$")
+	domainRegexp    = regexp.MustCompile("^[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// emailIDNA maps domains like idna.Lookup, but without the hyphen checks:
+// ASCII domains such as ab--cd.com that domainRegexp accepts stay valid.
+var emailIDNA = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.CheckHyphens(false))
+
+// ValidateFormat accepts internationalized addresses (RFC 6531): UTF-8 local
+// parts and IDN domains such as кириллица.рф, checked in their punycode form.
 func ValidateFormat(email string) error {
-	if !emailRegexp.MatchString(email) {
+	if !utf8.ValidString(email) {
+		return ErrBadFormat
+	}
+
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 || !localPartRegexp.MatchString(email[:i]) {
+		return ErrBadFormat
+	}
+
+	domain, err := emailIDNA.ToASCII(email[i+1:])
+	if err != nil || !domainRegexp.MatchString(domain) {
 		return ErrBadFormat
 	}
 	return nil
 }
 
+// NormalizeEmail returns the address with its domain lowercased and in
+// punycode, so equal addresses compare equal. The local part is kept as is,
+// it may be case-sensitive. Invalid domains are only lowercased.
+func NormalizeEmail(email string) string {
+	email = norm.NFC.String(email)
+	account, host := split(email)
+	if account == email {
+		return email
+	}
+
+	domain, err := emailIDNA.ToASCII(host)
+	if err != nil {
+		domain = strings.ToLower(host)
+	}
+	return account + "@" + domain
+}
+
 func ValidateHost(email string) error {
-	_, host := split(email)
-	mx, err := net.LookupMX(host)
+	return DefaultSMTPVerifier.Verify(email)
+}
+
+// EmailVerifier checks whether an email address is acceptable.
+type EmailVerifier interface {
+	Verify(email string) error
+}
+
+// FormatVerifier only checks the address syntax.
+type FormatVerifier struct{}
+
+func (v FormatVerifier) Verify(email string) error {
+	return ValidateFormat(email)
+}
+
+// MXVerifier checks the syntax and that the domain accepts mail, through MX
+// records or an A record.
+type MXVerifier struct {
+	Resolver Resolver
+}
+
+func (v MXVerifier) Verify(email string) error {
+	if err := ValidateFormat(email); err != nil {
+		return err
+	}
+	_, host := split(NormalizeEmail(email))
+	_, err := MailHosts(v.Resolver, host)
+	return err
+}
+
+// SMTPVerifier checks the syntax, the mail hosts and that the mail server
+// accepts the address as a recipient. Mail hosts are tried in MX preference
+// order until one answers; its reply is final.
+type SMTPVerifier struct {
+	HelloName string
+	MailFrom  string
+	Timeout   time.Duration
+	Resolver  Resolver
+
+	// Addr, when set, is dialed instead of the mail hosts on port 25.
+	Addr string
+}
+
+var DefaultSMTPVerifier = SMTPVerifier{
+	HelloName: "checkmail.me",
+	MailFrom:  "lansome-cowboy@gmail.com",
+	Timeout:   10 * time.Second,
+}
+
+func (v SMTPVerifier) Verify(email string) error {
+	if err := ValidateFormat(email); err != nil {
+		return err
+	}
+
+	email = NormalizeEmail(email)
+
+	addrs := []string{v.Addr}
+	if v.Addr == "" {
+		_, host := split(email)
+		hosts, err := MailHosts(v.Resolver, host)
+		if err != nil {
+			return err
+		}
+		addrs = addrs[:0]
+		for _, h := range hosts {
+			addrs = append(addrs, net.JoinHostPort(h, "25"))
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	for _, addr := range addrs {
+		conn, err = net.DialTimeout("tcp", addr, v.Timeout)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		return ErrUnresolvableHost
+		return NewSmtpError(err)
+	}
+	if v.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(v.Timeout))
 	}
 
-	client, err := smtp.Dial(fmt.Sprintf("%s:%d", mx[0].Host, 25))
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	client, err := smtp.NewClient(conn, host)
 	if err != nil {
+		conn.Close()
 		return NewSmtpError(err)
 	}
 	defer client.Close()
-	err = client.Hello("checkmail.me")
+	err = client.Hello(v.HelloName)
 	if err != nil {
 		return NewSmtpError(err)
 	}
-	err = client.Mail("lansome-cowboy@gmail.com")
+	err = client.Mail(v.MailFrom)
 	if err != nil {
 		return NewSmtpError(err)
 	}
@@ -68,8 +189,25 @@ func ValidateHost(email string) error {
 	return nil
 }
 
+// NewEmailVerifier returns the verifier for mode "format", "mx" or "smtp".
+// The SMTP settings are taken from DefaultSMTPVerifier.
+func NewEmailVerifier(mode string) (EmailVerifier, error) {
+	switch mode {
+	case "", "format":
+		return FormatVerifier{}, nil
+	case "mx":
+		return MXVerifier{Resolver: DefaultSMTPVerifier.Resolver}, nil
+	case "smtp":
+		return DefaultSMTPVerifier, nil
+	}
+	return nil, fmt.Errorf("unknown email verifier %q", mode)
+}
+
 func split(email string) (account, host string) {
 	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return email, ""
+	}
 	account = email[:i]
 	host = email[i+1:]
 	return
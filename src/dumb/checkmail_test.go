@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeSMTP serves a minimal SMTP dialog on a local port. RCPT TO is
+// answered by the recipient's local part: nobody@ gets 550, full@ gets 450,
+// anyone else 250.
+func startFakeSMTP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func serveFakeSMTP(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:<NOBODY@"):
+			reply("550 no such user")
+		case strings.HasPrefix(cmd, "RCPT TO:<FULL@"):
+			reply("450 mailbox full, try later")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPVerifier(t *testing.T) {
+	v := SMTPVerifier{
+		HelloName: "test.local",
+		MailFrom:  "check@test.local",
+		Timeout:   5 * time.Second,
+		Addr:      startFakeSMTP(t),
+	}
+
+	cases := []struct {
+		email  string
+		code   string
+		status string
+	}{
+		{"somebody@example.com", "", EmailStatusValid},
+		{"nobody@example.com", "550", EmailStatusInvalid},
+		{"full@example.com", "450", EmailStatusError},
+	}
+
+	for _, c := range cases {
+		err := v.Verify(c.email)
+
+		code := ""
+		if smtpErr, ok := err.(SmtpError); ok {
+			code = smtpErr.Code()
+		} else if err != nil {
+			t.Errorf("%s: %v, want an SMTP reply", c.email, err)
+			continue
+		}
+		if code != c.code {
+			t.Errorf("%s: reply %q, want %q", c.email, code, c.code)
+		}
+
+		if status := classifyEmailCheck(err).Status; status != c.status {
+			t.Errorf("%s: status %s, want %s", c.email, status, c.status)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	cases := []struct {
+		email string
+		valid bool
+	}{
+		{"foo@mail.ru", true},
+		{"Foo.Bar+tag@Mail.RU", true},
+		{"foo@ab--cd.com", true}, // hyphens in 3rd and 4th place are fine in ASCII
+		{"foo@xn--80apaahia1b8c.xn--p1ai", true},
+		{"foo@кириллица.рф", true},
+		{"foo@Кириллица.РФ", true},
+		{"пользователь@кириллица.рф", true},
+		{"müller@bücher.de", true},
+
+		{"", false},
+		{"foo", false},
+		{"@mail.ru", false},
+		{"foo@", false},
+		{"fo o@mail.ru", false},
+		{"foo@-bad.com", false},
+		{"foo@bad-.com", false},
+		{"foo@b..com", false},
+		{"foo@ex_ample.com", false},
+		{"foo@xn--zz.com", false},
+		{"\xff@mail.ru", false},
+	}
+
+	for _, c := range cases {
+		err := ValidateFormat(c.email)
+		if (err == nil) != c.valid {
+			t.Errorf("ValidateFormat(%q) = %v, want valid %v", c.email, err, c.valid)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		email string
+		want  string
+	}{
+		{"foo@mail.ru", "foo@mail.ru"},
+		{"Foo@Mail.RU", "Foo@mail.ru"}, // the local part keeps its case
+		{"foo@ab--cd.COM", "foo@ab--cd.com"},
+		{"foo@кириллица.рф", "foo@xn--80apaahia1b8c.xn--p1ai"},
+		{"foo@Кириллица.РФ", "foo@xn--80apaahia1b8c.xn--p1ai"},
+		{"foo@XN--80apaahia1b8c.xn--P1AI", "foo@xn--80apaahia1b8c.xn--p1ai"},
+		{"Пользователь@кириллица.рф", "Пользователь@xn--80apaahia1b8c.xn--p1ai"},
+		{"\u0438\u0306@mail.ru", "\u0439@mail.ru"}, // NFC: и with a combining breve is й
+		{"foo@Ex_Ample.com", "foo@ex_ample.com"},   // invalid, only lowercased
+		{"foo", "foo"},
+	}
+
+	for _, c := range cases {
+		if got := NormalizeEmail(c.email); got != c.want {
+			t.Errorf("NormalizeEmail(%q) = %q, want %q", c.email, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDomainBlocked = errors.New("email domain is not allowed")
+
+// DomainPolicy decides which email domains may sign up. It is read from a
+// file with one rule per line:
+//
+//	# throwaway providers
+//	block mailinator.com
+//	block *.tempmail.org
+//	allow good.tempmail.org
+//	default allow
+//
+// "*.d" matches every subdomain of d but not d itself. The most specific
+// matching rule wins: an exact domain, then the closest wildcard parent.
+// Domains matching no rule get the default, allow unless stated otherwise.
+type DomainPolicy struct {
+	rules        map[string]bool // pattern -> allowed
+	defaultAllow bool
+}
+
+func ParseDomainPolicy(path string) (*DomainPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &DomainPolicy{rules: make(map[string]bool), defaultAllow: true}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<allow|block|default> <domain>\"", path, line)
+		}
+
+		action, pattern := fields[0], fields[1]
+		if action == "default" {
+			if pattern != "allow" && pattern != "block" {
+				return nil, fmt.Errorf("%s:%d: default must be allow or block", path, line)
+			}
+			p.defaultAllow = pattern == "allow"
+			continue
+		}
+		if action != "allow" && action != "block" {
+			return nil, fmt.Errorf("%s:%d: unknown action %q", path, line, action)
+		}
+
+		wildcard := strings.HasPrefix(pattern, "*.")
+		domain, err := emailIDNA.ToASCII(strings.TrimPrefix(pattern, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad domain %q", path, line, pattern)
+		}
+		if wildcard {
+			domain = "*." + domain
+		}
+		p.rules[domain] = action == "allow"
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Allowed reports whether domain (any case, unicode or punycode) may be used.
+func (p *DomainPolicy) Allowed(domain string) bool {
+	ascii, err := emailIDNA.ToASCII(domain)
+	if err != nil {
+		ascii = strings.ToLower(domain)
+	}
+
+	if allowed, ok := p.rules[ascii]; ok {
+		return allowed
+	}
+	for d := ascii; ; {
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+		if allowed, ok := p.rules["*."+d]; ok {
+			return allowed
+		}
+	}
+	return p.defaultAllow
+}
+
+var domainPolicy atomic.Value // *DomainPolicy
+
+// CheckEmailDomain returns ErrDomainBlocked when the loaded policy rejects
+// the email's domain. Without a policy every domain is allowed.
+func CheckEmailDomain(email string) error {
+	p, _ := domainPolicy.Load().(*DomainPolicy)
+	if p == nil {
+		return nil
+	}
+
+	_, host := split(email)
+	if !p.Allowed(host) {
+		return ErrDomainBlocked
+	}
+	return nil
+}
+
+// WatchDomainPolicy loads the policy file and reloads it whenever its
+// modification time changes, checking every interval. A broken file keeps
+// the previous policy in place.
+func WatchDomainPolicy(path string, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	p, err := ParseDomainPolicy(path)
+	if err != nil {
+		return err
+	}
+	domainPolicy.Store(p)
+
+	go func() {
+		modTime := info.ModTime()
+		for range time.Tick(interval) {
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+
+			p, err := ParseDomainPolicy(path)
+			if err != nil {
+				log.Printf("Domain policy not reloaded: %s", err)
+				continue
+			}
+			domainPolicy.Store(p)
+			log.Printf("Domain policy reloaded from %s", path)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePolicy(t *testing.T, path string, text string) {
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// policyDir makes a temporary directory, the caller removes it
+func policyDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "domainpolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestParseDomainPolicyErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		err  string
+	}{
+		{"one field", "block\n", ":1: expected"},
+		{"three fields", "# comment\n\nblock a.com b.com\n", ":3: expected"},
+		{"bad default", "default maybe\n", ":1: default must be allow or block"},
+		{"unknown action", "deny a.com\n", `:1: unknown action "deny"`},
+		{"bad domain", "block ex_ample.com\n", `:1: bad domain "ex_ample.com"`},
+	}
+
+	dir := policyDir(t)
+	defer os.RemoveAll(dir)
+	for _, c := range cases {
+		path := filepath.Join(dir, "policy")
+		writePolicy(t, path, c.text)
+
+		p, err := ParseDomainPolicy(path)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, %v, want error containing %q", c.name, p, err, c.err)
+		}
+	}
+
+	if _, err := ParseDomainPolicy(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestDomainPolicyAllowed(t *testing.T) {
+	policies := map[string]string{
+		"default allow": `
+block mailinator.com
+block *.tempmail.org
+allow good.tempmail.org
+allow *.ok.tempmail.org
+block *.почта.рф
+`,
+		"default block": `
+default block
+allow mail.ru
+allow *.xn--80a1acny.xn--p1ai
+`,
+	}
+
+	cases := []struct {
+		policy  string
+		domain  string
+		allowed bool
+	}{
+		{"default allow", "mailinator.com", false},
+		{"default allow", "MailInator.COM", false},
+		{"default allow", "sub.mailinator.com", true}, // exact rules don't cover subdomains
+		{"default allow", "x.tempmail.org", false},
+		{"default allow", "a.b.tempmail.org", false},
+		{"default allow", "tempmail.org", true},      // *.d does not match d
+		{"default allow", "good.tempmail.org", true}, // exact beats wildcard
+		{"default allow", "x.good.tempmail.org", false},
+		{"default allow", "x.ok.tempmail.org", true}, // closer wildcard wins
+		{"default allow", "ok.tempmail.org", false},
+		{"default allow", "ящик.почта.рф", false},
+		{"default allow", "xn--h1aigbl.xn--80a1acny.xn--p1ai", false},
+		{"default allow", "почта.рф", true},
+		{"default allow", "gmail.com", true},
+
+		{"default block", "gmail.com", false},
+		{"default block", "mail.ru", true},
+		{"default block", "sub.mail.ru", false},
+		{"default block", "ящик.почта.рф", true},
+		{"default block", "почта.рф", false},
+	}
+
+	dir := policyDir(t)
+	defer os.RemoveAll(dir)
+	parsed := make(map[string]*DomainPolicy)
+	for name, text := range policies {
+		path := filepath.Join(dir, strings.Replace(name, " ", "_", -1))
+		writePolicy(t, path, text)
+		p, err := ParseDomainPolicy(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		parsed[name] = p
+	}
+
+	for _, c := range cases {
+		if got := parsed[c.policy].Allowed(c.domain); got != c.allowed {
+			t.Errorf("%s: Allowed(%q) = %v, want %v", c.policy, c.domain, got, c.allowed)
+		}
+	}
+}
+
+func TestWatchDomainPolicyReload(t *testing.T) {
+	defer domainPolicy.Store((*DomainPolicy)(nil))
+
+	dir := policyDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy")
+	writePolicy(t, path, "block mailinator.com\n")
+
+	if err := WatchDomainPolicy(path, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckEmailDomain("a@mailinator.com"); err != ErrDomainBlocked {
+		t.Fatalf("before reload: %v", err)
+	}
+
+	// Bumped past the filesystem's mtime resolution
+	touch := func(text string, age time.Duration) {
+		writePolicy(t, path, text)
+		mtime := time.Now().Add(age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor := func(email string, want error) {
+		deadline := time.Now().Add(2 * time.Second)
+		for CheckEmailDomain(email) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: still %v, want %v", email, CheckEmailDomain(email), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	touch("block tempmail.org\n", time.Hour)
+	waitFor("a@mailinator.com", nil)
+	waitFor("a@tempmail.org", ErrDomainBlocked)
+
+	// A broken file keeps the previous policy
+	touch("deny everything\n", 2*time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if err := CheckEmailDomain("a@tempmail.org"); err != ErrDomainBlocked {
+		t.Errorf("after broken reload: %v", err)
+	}
+}
+
+// Users already on a domain blocked later can still be edited.
+func TestUserValidateBlockedDomain(t *testing.T) {
+	defer domainPolicy.Store((*DomainPolicy)(nil))
+
+	dir := policyDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy")
+	writePolicy(t, path, "block mailinator.com\n")
+	p, err := ParseDomainPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainPolicy.Store(p)
+
+	u := User{ID: 1, Email: "a@mailinator.com", FirstName: "Иван", LastName: "Петров", Gender: "m"}
+	if err := UserValidate(u, true); err != errDomainBlocked {
+		t.Errorf("new address: %v, want %v", err, errDomainBlocked)
+	}
+	if err := UserValidate(u, false); err != nil {
+		t.Errorf("unchanged address: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "log"
+  "net/textproto"
+  "sync"
+  "time"
+)
+
+// Background deliverability checks. New and changed user emails are queued
+// and probed with ValidateHost-style SMTP checks by a fixed pool of workers,
+// so user POSTs never wait on the network. Results are kept per user and
+// shown by /users/:id?expand=email_status.
+
+const (
+  EmailStatusUnknown = "unknown"
+  EmailStatusValid   = "valid"
+  EmailStatusInvalid = "invalid"
+  EmailStatusError   = "error"
+)
+
+type EmailStatus struct {
+  Status     string  `json:"status"`
+  Code       string  `json:"code,omitempty"`
+  CheckedAt  int64   `json:"checked_at,omitempty"`
+}
+
+type emailCheck struct {
+  UserID     int
+  Email      string
+  Attempt    int
+}
+
+var hlEmailStatus = make(map[int]EmailStatus)
+var hlEmailStatusMutex sync.Mutex
+
+var emailChecks chan emailCheck
+var emailCheckVerifier EmailVerifier = DefaultSMTPVerifier
+var emailCheckRetries = 3
+var emailCheckBackoff = 30 * time.Second
+
+// StartEmailChecks runs workers goroutines over a queue of queueSize checks.
+// Until it is called QueueEmailCheck is a no-op and statuses stay unknown.
+func StartEmailChecks(workers int, queueSize int, verifier EmailVerifier) {
+  emailCheckVerifier = verifier
+  emailChecks = make(chan emailCheck, queueSize)
+
+  for i := 0; i < workers; i++ {
+    go emailCheckWorker()
+  }
+}
+
+func GetEmailStatus(uid int) EmailStatus {
+  hlEmailStatusMutex.Lock()
+  status, ok := hlEmailStatus[uid]
+  hlEmailStatusMutex.Unlock()
+
+  if !ok {
+    return EmailStatus{Status: EmailStatusUnknown}
+  }
+  return status
+}
+
+func setEmailStatus(uid int, status EmailStatus) {
+  hlEmailStatusMutex.Lock()
+  hlEmailStatus[uid] = status
+  hlEmailStatusMutex.Unlock()
+}
+
+// QueueEmailCheck resets the user's status to unknown and schedules a check.
+// A full queue drops the check rather than blocking the request. Both happen
+// under hlUsersMutex and only while email is still the user's: a late call
+// for an address already replaced must not reset the newer one's status,
+// whose check may be done.
+func QueueEmailCheck(uid int, email string) {
+  if emailChecks == nil {
+    return
+  }
+
+  hlUsersMutex.Lock()
+  if hlUsersData[uid].Email == email {
+    setEmailStatus(uid, EmailStatus{Status: EmailStatusUnknown})
+    enqueueEmailCheck(emailCheck{uid, email, 0})
+  }
+  hlUsersMutex.Unlock()
+}
+
+func enqueueEmailCheck(c emailCheck) {
+  select {
+  case emailChecks <- c:
+  default:
+    log.Printf("Email check queue full, skipping user %d", c.UserID)
+  }
+}
+
+func emailCheckWorker() {
+  for c := range emailChecks {
+    status := classifyEmailCheck(emailCheckVerifier.Verify(c.Email))
+    retry := status.Status == EmailStatusError && c.Attempt < emailCheckRetries
+
+    // The email may have changed while we were waiting on the network. The
+    // status is set under the same lock, so it can't land on a newer address.
+    hlUsersMutex.Lock()
+    current := hlUsersData[c.UserID].Email == c.Email
+    if current && !retry {
+      status.CheckedAt = time.Now().Unix()
+      setEmailStatus(c.UserID, status)
+    }
+    hlUsersMutex.Unlock()
+
+    if current && retry {
+      next := c
+      next.Attempt += 1
+      time.AfterFunc(emailCheckBackoff * time.Duration(next.Attempt), func() {
+        enqueueEmailCheck(next)
+      })
+    }
+  }
+}
+
+// classifyEmailCheck maps a verifier error to a status. Permanent SMTP
+// rejections (5xx) and bad or unresolvable addresses are invalid, anything
+// else (4xx, DNS failures, timeouts, connection errors) is an error worth
+// retrying.
+func classifyEmailCheck(err error) EmailStatus {
+  if err == nil {
+    return EmailStatus{Status: EmailStatusValid}
+  }
+
+  if err == ErrBadFormat || err == ErrUnresolvableHost {
+    return EmailStatus{Status: EmailStatusInvalid}
+  }
+
+  if smtpErr, ok := err.(SmtpError); ok {
+    if protoErr, ok := smtpErr.Err.(*textproto.Error); ok {
+      if protoErr.Code >= 500 {
+        return EmailStatus{Status: EmailStatusInvalid, Code: smtpErr.Code()}
+      }
+      return EmailStatus{Status: EmailStatusError, Code: smtpErr.Code()}
+    }
+  }
+
+  return EmailStatus{Status: EmailStatusError}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+  "net/textproto"
+  "sync"
+  "testing"
+  "time"
+)
+
+// flakyVerifier fails every address with a 450 its first failures times,
+// then accepts it. Addresses in invalid are rejected with a 550 every time.
+type flakyVerifier struct {
+  mu       sync.Mutex
+  failures int
+  invalid  map[string]bool
+  calls    map[string]int
+}
+
+func (v *flakyVerifier) Verify(email string) error {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+
+  v.calls[email] += 1
+  if v.invalid[email] {
+    return NewSmtpError(&textproto.Error{Code: 550, Msg: "no such user"})
+  }
+  if v.calls[email] <= v.failures {
+    return NewSmtpError(&textproto.Error{Code: 450, Msg: "try later"})
+  }
+  return nil
+}
+
+func (v *flakyVerifier) Calls(email string) int {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return v.calls[email]
+}
+
+// startTestEmailChecks runs the queue with short backoffs against verifier.
+// The returned func puts the globals back; workers are left blocked on the
+// dropped queue.
+func startTestEmailChecks(workers int, queueSize int, verifier EmailVerifier) func() {
+  retries, backoff, oldVerifier := emailCheckRetries, emailCheckBackoff, emailCheckVerifier
+  emailCheckBackoff = time.Millisecond
+
+  hlEmailStatusMutex.Lock()
+  hlEmailStatus = make(map[int]EmailStatus)
+  hlEmailStatusMutex.Unlock()
+
+  StartEmailChecks(workers, queueSize, verifier)
+
+  return func() {
+    emailChecks = nil
+    emailCheckRetries, emailCheckBackoff, emailCheckVerifier = retries, backoff, oldVerifier
+  }
+}
+
+func setTestUserEmail(uid int, email string) {
+  hlUsersMutex.Lock()
+  hlUsersData[uid] = User{ID: uid, Email: email}
+  hlUsersMutex.Unlock()
+}
+
+// waitEmailStatus waits for the user's status to leave unknown.
+func waitEmailStatus(t *testing.T, uid int) EmailStatus {
+  deadline := time.Now().Add(2 * time.Second)
+  for {
+    status := GetEmailStatus(uid)
+    if status.Status != EmailStatusUnknown {
+      return status
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("user %d: status still unknown", uid)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestEmailCheckRetries(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  cases := []struct {
+    name     string
+    failures int
+    retries  int
+    status   string
+    code     string
+    calls    int
+  }{
+    {"first try", 0, 3, EmailStatusValid, "", 1},
+    {"valid after retries", 2, 3, EmailStatusValid, "", 3},
+    {"valid on the last retry", 3, 3, EmailStatusValid, "", 4},
+    {"retries exhausted", 10, 3, EmailStatusError, "450", 4},
+    {"no retries", 10, 0, EmailStatusError, "450", 1},
+  }
+
+  for _, c := range cases {
+    verifier := &flakyVerifier{failures: c.failures, calls: make(map[string]int)}
+    stop := startTestEmailChecks(1, 10, verifier)
+    emailCheckRetries = c.retries
+
+    setTestUserEmail(1, "a@mail.ru")
+    QueueEmailCheck(1, "a@mail.ru")
+    status := waitEmailStatus(t, 1)
+
+    // Nothing is retried after the final status
+    time.Sleep(20 * time.Millisecond)
+    if status.Status != c.status || status.Code != c.code || verifier.Calls("a@mail.ru") != c.calls {
+      t.Errorf("%s: %s %q after %d calls, want %s %q after %d",
+        c.name, status.Status, status.Code, verifier.Calls("a@mail.ru"), c.status, c.code, c.calls)
+    }
+    if status.CheckedAt == 0 {
+      t.Errorf("%s: no checked_at", c.name)
+    }
+    stop()
+  }
+}
+
+// Checks of an address the user no longer has neither reset nor set the
+// status of the current one.
+func TestEmailCheckChangedEmail(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  verifier := &flakyVerifier{invalid: map[string]bool{"b@mail.ru": true}, calls: make(map[string]int)}
+  defer startTestEmailChecks(1, 10, verifier)()
+
+  // Changed to b and then to c, c is checked first
+  setTestUserEmail(1, "c@mail.ru")
+  QueueEmailCheck(1, "c@mail.ru")
+  if status := waitEmailStatus(t, 1); status.Status != EmailStatusValid {
+    t.Fatalf("c@mail.ru: %s, want valid", status.Status)
+  }
+
+  // The late call for b changes nothing
+  QueueEmailCheck(1, "b@mail.ru")
+  if status := GetEmailStatus(1); status.Status != EmailStatusValid {
+    t.Errorf("after a late QueueEmailCheck for b: %s, want valid", status.Status)
+  }
+
+  // A check for b already in the queue is verified but dropped. With one
+  // worker, user 2's status means b's check is done.
+  enqueueEmailCheck(emailCheck{1, "b@mail.ru", 0})
+  setTestUserEmail(2, "d@mail.ru")
+  QueueEmailCheck(2, "d@mail.ru")
+  waitEmailStatus(t, 2)
+
+  if verifier.Calls("b@mail.ru") != 1 {
+    t.Errorf("b@mail.ru verified %d times, want 1", verifier.Calls("b@mail.ru"))
+  }
+  if status := GetEmailStatus(1); status.Status != EmailStatusValid {
+    t.Errorf("after a stale check for b: %s, want valid", status.Status)
+  }
+}
+
+// A full queue drops the check instead of blocking the request.
+func TestEmailCheckQueueFull(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  defer startTestEmailChecks(0, 1, &flakyVerifier{calls: make(map[string]int)})()
+
+  setTestUserEmail(1, "a@mail.ru")
+  setTestUserEmail(2, "b@mail.ru")
+
+  done := make(chan bool)
+  go func() {
+    QueueEmailCheck(1, "a@mail.ru")
+    QueueEmailCheck(2, "b@mail.ru")
+    done <- true
+  }()
+
+  select {
+  case <-done:
+  case <-time.After(time.Second):
+    t.Fatal("QueueEmailCheck blocked on a full queue")
+  }
+
+  if len(emailChecks) != 1 {
+    t.Fatalf("%d checks queued, want 1", len(emailChecks))
+  }
+  if c := <-emailChecks; c.UserID != 1 {
+    t.Errorf("queued check for user %d, want 1", c.UserID)
+  }
+}
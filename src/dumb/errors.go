@@ -0,0 +1,73 @@
+package main
+
+// Failed requests answer with
+//   {"error": {"code": "invalid_parameter", "field": "toDate", "message": "..."}}
+// code is stable and machine-readable, field names the offending query
+// parameter or JSON field when there is one.
+
+type APIError struct {
+  Code       string  `json:"code"`
+  Field      string  `json:"field,omitempty"`
+  Message    string  `json:"message"`
+}
+
+func (e *APIError) Error() string {
+  return e.Message
+}
+
+type ErrorOut struct {
+  Error      *APIError `json:"error"`
+}
+
+// Set from COMPAT_EMPTY_ERRORS: failures keep their old bodies, which is
+// what the load-test checker expects. That is an empty body, except for a
+// blocked email domain, which was {"error": "email_domain_blocked"} before
+// the error model and is told apart by clients on it.
+var compatEmptyErrors = false
+
+var compatDomainBlockedResponse = []byte("{\"error\": \"email_domain_blocked\"}")
+
+func errorResponse(status int, e *APIError) (int, []byte) {
+  if compatEmptyErrors {
+    if e == errDomainBlocked {
+      return status, compatDomainBlockedResponse
+    }
+    return status, emptyResponse
+  }
+  return status, []byte(toJson(ErrorOut{e}))
+}
+
+func notFoundResponse() (int, []byte) {
+  return errorResponse(404, errNotFound)
+}
+
+func badParam(name string) *APIError {
+  return &APIError{"invalid_parameter", name, "invalid value of query parameter " + name}
+}
+
+func badField(name string, message string) *APIError {
+  return &APIError{"invalid_field", name, message}
+}
+
+var (
+  errNotFound         = &APIError{"not_found", "", "no such object"}
+  errMethodNotAllowed = &APIError{"method_not_allowed", "", "method is not allowed for this path"}
+  errInvalidJSON      = &APIError{"invalid_json", "", "request body is not a valid JSON object"}
+  errIDRequired       = &APIError{"id_required", "id", "id is required when creating"}
+  errIDNotAllowed     = &APIError{"id_not_allowed", "id", "id can not be changed"}
+  errIDExists         = &APIError{"id_exists", "id", "an object with this id already exists"}
+  errEmailTaken       = &APIError{"email_taken", "email", "email is used by another user"}
+  errDomainBlocked    = &APIError{"email_domain_blocked", "email", "email domain is not allowed"}
+)
+
+func unknownReference(name string) *APIError {
+  return &APIError{"unknown_reference", name, "no " + name + " with this id"}
+}
+
+func missingField(name string) *APIError {
+  return &APIError{"missing_field", name, name + " is required"}
+}
+
+func nullField(name string) *APIError {
+  return &APIError{"null_value", name, name + " can not be null"}
+}
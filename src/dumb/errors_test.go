@@ -0,0 +1,30 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestErrorResponseCompat(t *testing.T) {
+  defer func(compat bool) { compatEmptyErrors = compat }(compatEmptyErrors)
+
+  cases := []struct {
+    compat bool
+    err    *APIError
+    body   string
+  }{
+    {false, badParam("toDate"), `{"error":{"code":"invalid_parameter","field":"toDate","message":"invalid value of query parameter toDate"}}`},
+    {true, badParam("toDate"), ``},
+    {true, errNotFound, ``},
+    {false, errDomainBlocked, `{"error":{"code":"email_domain_blocked","field":"email","message":"email domain is not allowed"}}`},
+    // The blocked domain keeps its body from before the error model
+    {true, errDomainBlocked, `{"error": "email_domain_blocked"}`},
+  }
+
+  for _, c := range cases {
+    compatEmptyErrors = c.compat
+    status, body := errorResponse(400, c.err)
+    if status != 400 || string(body) != c.body {
+      t.Errorf("compat %v, %s: %d %s, want 400 %s", c.compat, c.err.Code, status, body, c.body)
+    }
+  }
+}
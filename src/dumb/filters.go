@@ -0,0 +1,457 @@
+package main
+
+import (
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/valyala/fasthttp"
+  "golang.org/x/text/unicode/norm"
+)
+
+// Query parameters are parsed once per request into a filter struct,
+// the visit loop then only compares already parsed values.
+
+type UserVisitsFilter struct {
+  HasFromDate      bool
+  FromDate         int64
+  HasToDate        bool
+  ToDate           int64
+  HasFromDistance  bool
+  FromDistance     int
+  HasToDistance    bool
+  ToDistance       int
+  HasFromMark      bool
+  FromMark         int
+  HasToMark        bool
+  ToMark           int
+  Countries        []string
+  HasCity          bool
+  City             string
+  HasPlace         bool
+  Place            string
+}
+
+// queryInt reads an integer query parameter. Zero is rejected unless allowZero
+// is set, same as the original per-handler checks did.
+func queryInt(params *fasthttp.Args, name string, allowZero bool) (int, bool, bool) {
+  if !params.Has(name) {
+    return 0, false, true
+  }
+
+  p0, err := strconv.Atoi(string(params.Peek(name)))
+  if err != nil || (p0 == 0 && !allowZero) {
+    return 0, true, false
+  }
+
+  return p0, true, true
+}
+
+func queryMark(params *fasthttp.Args, name string) (int, bool, bool) {
+  p0, has, ok := queryInt(params, name, true)
+  if ok && has && (p0 < 0 || p0 > 5) {
+    return 0, true, false
+  }
+  return p0, has, ok
+}
+
+func ParseUserVisitsFilter(params *fasthttp.Args) (UserVisitsFilter, *APIError) {
+  var f UserVisitsFilter
+  var p0 int
+  var ok bool
+
+  p0, f.HasFromDate, ok = queryInt(params, "fromDate", false)
+  if !ok {
+    return f, badParam("fromDate")
+  }
+  f.FromDate = int64(p0)
+
+  p0, f.HasToDate, ok = queryInt(params, "toDate", false)
+  if !ok {
+    return f, badParam("toDate")
+  }
+  f.ToDate = int64(p0)
+
+  // fromDistance=0 is a real bound, it leaves out distance 0
+  f.FromDistance, f.HasFromDistance, ok = queryInt(params, "fromDistance", true)
+  if !ok {
+    return f, badParam("fromDistance")
+  }
+
+  f.ToDistance, f.HasToDistance, ok = queryInt(params, "toDistance", false)
+  if !ok {
+    return f, badParam("toDistance")
+  }
+
+  f.FromMark, f.HasFromMark, ok = queryMark(params, "fromMark")
+  if !ok {
+    return f, badParam("fromMark")
+  }
+
+  f.ToMark, f.HasToMark, ok = queryMark(params, "toMark")
+  if !ok {
+    return f, badParam("toMark")
+  }
+
+  if params.Has("country") {
+    f.Countries = append(f.Countries, norm.NFC.String(string(params.Peek("country"))))
+  }
+
+  if params.Has("countries") {
+    // countries=Россия,Германия, either this or country
+    if params.Has("country") {
+      return f, badParam("countries")
+    }
+
+    for _, c := range strings.Split(string(params.Peek("countries")), ",") {
+      if c == "" {
+        return f, badParam("countries")
+      }
+      f.Countries = append(f.Countries, norm.NFC.String(c))
+    }
+  }
+
+  if params.Has("city") {
+    f.HasCity = true
+    f.City = norm.NFC.String(string(params.Peek("city")))
+  }
+
+  if params.Has("place") {
+    f.HasPlace = true
+    f.Place = norm.NFC.String(string(params.Peek("place")))
+  }
+
+  return f, nil
+}
+
+// Match reports whether visit v at location l passes the filter. Dates and
+// distances are strict bounds, marks are inclusive on both ends.
+func (f *UserVisitsFilter) Match(v *Visit, l *Location) bool {
+  if f.HasFromDate && v.VisitedAt <= f.FromDate {
+    return false
+  }
+
+  if f.HasToDate && v.VisitedAt >= f.ToDate {
+    return false
+  }
+
+  if f.HasFromMark && *v.Mark < f.FromMark {
+    return false
+  }
+
+  if f.HasToMark && *v.Mark > f.ToMark {
+    return false
+  }
+
+  if f.HasFromDistance && l.Distance <= f.FromDistance {
+    return false
+  }
+
+  if f.HasToDistance && l.Distance >= f.ToDistance {
+    return false
+  }
+
+  if len(f.Countries) > 0 {
+    found := false
+    for _, c := range f.Countries {
+      if l.Country == c {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+
+  if f.HasCity && l.City != f.City {
+    return false
+  }
+
+  if f.HasPlace && !strings.Contains(l.Place, f.Place) {
+    return false
+  }
+
+  return true
+}
+
+// Sorting and paging of /users/:id/visits. Visits are collected as UserVisit
+// so every sort key is at hand, then trimmed to the requested page.
+
+type UserVisitsOrder struct {
+  Key        string
+  Desc       bool
+  Offset     int
+  Limit      int
+}
+
+func ParseUserVisitsOrder(params *fasthttp.Args) (UserVisitsOrder, *APIError) {
+  o := UserVisitsOrder{Key: "visited_at"}
+
+  if params.Has("sort") {
+    o.Key = string(params.Peek("sort"))
+    if o.Key != "visited_at" && o.Key != "mark" && o.Key != "distance" && o.Key != "place" {
+      return o, badParam("sort")
+    }
+  }
+
+  if params.Has("order") {
+    order := string(params.Peek("order"))
+    if order == "desc" {
+      o.Desc = true
+    } else if order != "asc" {
+      return o, badParam("order")
+    }
+  }
+
+  var apiErr *APIError
+  o.Offset, o.Limit, apiErr = queryPage(params)
+
+  return o, apiErr
+}
+
+// queryPage reads offset and limit, a missing limit (0) means no limit.
+func queryPage(params *fasthttp.Args) (int, int, *APIError) {
+  offset, _, ok := queryInt(params, "offset", true)
+  if !ok || offset < 0 {
+    return 0, 0, badParam("offset")
+  }
+
+  limit, _, ok := queryInt(params, "limit", false)
+  if !ok || limit < 0 {
+    return 0, 0, badParam("limit")
+  }
+
+  return offset, limit, nil
+}
+
+func pageBounds(n int, offset int, limit int) (int, int) {
+  if offset >= n {
+    return n, n
+  }
+  if limit > 0 && offset + limit < n {
+    return offset, offset + limit
+  }
+  return offset, n
+}
+
+type UserVisitsSorter struct {
+  Visits     []UserVisit
+  Order      UserVisitsOrder
+}
+
+func (s UserVisitsSorter) Len() int {
+  return len(s.Visits)
+}
+
+func (s UserVisitsSorter) Swap(i, j int) {
+  s.Visits[i], s.Visits[j] = s.Visits[j], s.Visits[i]
+}
+
+func (s UserVisitsSorter) Less(i, j int) bool {
+  if s.Order.Desc {
+    i, j = j, i
+  }
+  a, b := &s.Visits[i], &s.Visits[j]
+
+  switch s.Order.Key {
+  case "mark":
+    if a.Mark != b.Mark {
+      return a.Mark < b.Mark
+    }
+  case "distance":
+    if a.Distance != b.Distance {
+      return a.Distance < b.Distance
+    }
+  case "place":
+    if a.Place != b.Place {
+      return a.Place < b.Place
+    }
+  }
+
+  // Ties (and the default key) are broken by date, then by visit id,
+  // so pages stay stable between requests.
+  if a.VisitedAt != b.VisitedAt {
+    return a.VisitedAt < b.VisitedAt
+  }
+  return a.ID < b.ID
+}
+
+// Page sorts visits and returns the slice selected by offset and limit.
+func (o *UserVisitsOrder) Page(visits []UserVisit) []UserVisit {
+  sort.Sort(UserVisitsSorter{visits, *o})
+
+  from, to := pageBounds(len(visits), o.Offset, o.Limit)
+  return visits[from:to]
+}
+
+// Extra per-visit fields clients may opt into with fields=id,city,...
+// or expand=location. Without either the output is the classic
+// place/visited_at/mark triple.
+
+type UserVisitFields struct {
+  ID         bool
+  Location   bool
+  City       bool
+  Country    bool
+  Distance   bool
+}
+
+func ParseUserVisitFields(params *fasthttp.Args) (UserVisitFields, *APIError) {
+  var f UserVisitFields
+
+  if params.Has("expand") {
+    for _, e := range strings.Split(string(params.Peek("expand")), ",") {
+      if e != "location" {
+        return f, badParam("expand")
+      }
+      f.Location, f.City, f.Country, f.Distance = true, true, true, true
+    }
+  }
+
+  if params.Has("fields") {
+    for _, name := range strings.Split(string(params.Peek("fields")), ",") {
+      switch name {
+      case "place", "visited_at", "mark":
+        // always present
+      case "id":
+        f.ID = true
+      case "location":
+        f.Location = true
+      case "city":
+        f.City = true
+      case "country":
+        f.Country = true
+      case "distance":
+        f.Distance = true
+      default:
+        return f, badParam("fields")
+      }
+    }
+  }
+
+  return f, nil
+}
+
+func (f *UserVisitFields) Out(uv *UserVisit) UserVisitOut {
+  out := UserVisitOut{Place: uv.Place, VisitedAt: uv.VisitedAt, Mark: uv.Mark}
+
+  if f.ID {
+    out.ID = &uv.ID
+  }
+  if f.Location {
+    out.Location = &uv.LocationID
+  }
+  if f.City {
+    out.City = &uv.City
+  }
+  if f.Country {
+    out.Country = &uv.Country
+  }
+  if f.Distance {
+    out.Distance = &uv.Distance
+  }
+
+  return out
+}
+
+// Filters shared by the per-location aggregates (/avg, /stats).
+
+type LocationVisitsFilter struct {
+  HasFromDate      bool
+  FromDate         int64
+  HasToDate        bool
+  ToDate           int64
+  HasFromAge       bool
+  FromAge          int
+  HasToAge         bool
+  ToAge            int
+  HasGender        bool
+  Gender           string
+
+  // Ages as birth_date bounds, fixed once per request: fromAge keeps users
+  // born at or before MaxBirthDate, toAge those born after MinBirthDate.
+  MaxBirthDate     int64
+  MinBirthDate     int64
+
+  // The request time in AgeLocation the bounds are taken at. Age buckets and
+  // ages shown for the same request are taken at it too.
+  Now              time.Time
+}
+
+func ParseLocationVisitsFilter(params *fasthttp.Args) (LocationVisitsFilter, *APIError) {
+  var f LocationVisitsFilter
+  var p0 int
+  var ok bool
+
+  p0, f.HasFromDate, ok = queryInt(params, "fromDate", false)
+  if !ok {
+    return f, badParam("fromDate")
+  }
+  f.FromDate = int64(p0)
+
+  p0, f.HasToDate, ok = queryInt(params, "toDate", false)
+  if !ok {
+    return f, badParam("toDate")
+  }
+  f.ToDate = int64(p0)
+
+  f.FromAge, f.HasFromAge, ok = queryInt(params, "fromAge", false)
+  if !ok {
+    return f, badParam("fromAge")
+  }
+
+  f.ToAge, f.HasToAge, ok = queryInt(params, "toAge", false)
+  if !ok {
+    return f, badParam("toAge")
+  }
+
+  now := time.Now().In(AgeLocation)
+  f.Now = now
+  if f.HasFromAge {
+    f.MaxBirthDate = LatestBirthAt(f.FromAge, now)
+  }
+  if f.HasToAge {
+    f.MinBirthDate = LatestBirthAt(f.ToAge, now)
+  }
+
+  if params.Has("gender") {
+    f.HasGender = true
+    f.Gender = string(params.Peek("gender"))
+    if f.Gender != "m" && f.Gender != "f" {
+      return f, badParam("gender")
+    }
+  }
+
+  return f, nil
+}
+
+// Match reports whether visit v by user u passes the filter. Dates are strict
+// bounds, fromAge is inclusive and toAge exclusive.
+func (f *LocationVisitsFilter) Match(v *Visit, u *User) bool {
+  if f.HasFromDate && v.VisitedAt <= f.FromDate {
+    return false
+  }
+
+  if f.HasToDate && v.VisitedAt >= f.ToDate {
+    return false
+  }
+
+  if f.HasGender && u.Gender != f.Gender {
+    return false
+  }
+
+  if f.HasFromAge && u.BirthDate > f.MaxBirthDate {
+    return false
+  }
+
+  if f.HasToAge && u.BirthDate <= f.MinBirthDate {
+    return false
+  }
+
+  return true
+}
+
+func (f *LocationVisitsFilter) IsEmpty() bool {
+  return !f.HasFromDate && !f.HasToDate && !f.HasFromAge && !f.HasToAge && !f.HasGender
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+  "github.com/valyala/fasthttp"
+)
+
+func TestParseUserVisitsFilter(t *testing.T) {
+  cases := []struct {
+    query      string
+    countries  []string
+    from       int
+    hasFrom    bool
+    err        *APIError
+  }{
+    {"country=Россия", []string{"Россия"}, 0, false, nil},
+    {"countries=Россия,Германия", []string{"Россия", "Германия"}, 0, false, nil},
+    {"country=Россия&countries=Германия", nil, 0, false, badParam("countries")},
+    {"countries=Россия,", nil, 0, false, badParam("countries")},
+    {"fromDistance=0", nil, 0, true, nil},
+    {"fromDistance=7", nil, 7, true, nil},
+    {"fromDistance=x", nil, 0, false, badParam("fromDistance")},
+  }
+
+  for _, c := range cases {
+    var args fasthttp.Args
+    args.Parse(c.query)
+
+    f, err := ParseUserVisitsFilter(&args)
+    if !reflect.DeepEqual(err, c.err) {
+      t.Errorf("%s: error %v, want %v", c.query, err, c.err)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+    if !reflect.DeepEqual(f.Countries, c.countries) || f.FromDistance != c.from || f.HasFromDistance != c.hasFrom {
+      t.Errorf("%s: countries %q, fromDistance %d %v, want %q, %d %v",
+        c.query, f.Countries, f.FromDistance, f.HasFromDistance, c.countries, c.from, c.hasFrom)
+    }
+  }
+}
+
+func testGET(h func(ctx *fasthttp.RequestCtx, id int) (int, []byte), id int, query string) (int, []byte) {
+  var ctx fasthttp.RequestCtx
+  ctx.Request.Header.SetMethod("GET")
+  ctx.Request.SetRequestURI("/?" + query)
+  return h(&ctx, id)
+}
+
+// Without fields= or expand= the items are the same bytes as before either
+// existed, opted-in zero values are still printed.
+func TestUsersVisitsFields(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  mark := 4
+  hlUsersData[1] = User{ID: 1, Email: "a@mail.ru", Gender: "m"}
+  hlLocationsData[7] = Location{ID: 7, Place: "Парк", City: "Москва", Country: "Россия", Distance: 0}
+  hlVisitsData[5] = &Visit{ID: 5, User: 1, Location: 7, VisitedAt: 1000000000, Mark: &mark}
+  hlVisitsByUser[1] = []int{5}
+  hlVisitsByLoc[7] = []int{5}
+
+  cases := []struct {
+    query  string
+    status int
+    body   string
+  }{
+    {"", 200, `{"visits":[{"place":"Парк","visited_at":1000000000,"mark":4}]}`},
+    {"fields=place,mark", 200, `{"visits":[{"place":"Парк","visited_at":1000000000,"mark":4}]}`},
+    {"fields=distance", 200, `{"visits":[{"place":"Парк","visited_at":1000000000,"mark":4,"distance":0}]}`},
+    {"fields=id,location", 200, `{"visits":[{"place":"Парк","visited_at":1000000000,"mark":4,"id":5,"location":7}]}`},
+    {"expand=location", 200, `{"visits":[{"place":"Парк","visited_at":1000000000,"mark":4,"location":7,"city":"Москва","country":"Россия","distance":0}]}`},
+    {"fields=age", 400, ""},
+  }
+
+  defer func(compat bool) { compatEmptyErrors = compat }(compatEmptyErrors)
+  compatEmptyErrors = true
+
+  for _, c := range cases {
+    status, body := testGET(UsersHandlerGETVisits, 1, c.query)
+    if status != c.status || string(body) != c.body {
+      t.Errorf("%q: %d %s, want %d %s", c.query, status, body, c.status, c.body)
+    }
+  }
+}
+
+func TestPageBounds(t *testing.T) {
+  cases := []struct {
+    n, offset, limit int
+    from, to         int
+  }{
+    {5, 0, 0, 0, 5},
+    {5, 1, 2, 1, 3},
+    {5, 3, 10, 3, 5}, // limit beyond the remaining items
+    {5, 3, 2, 3, 5},
+    {5, 5, 2, 5, 5},
+    {5, 9, 0, 5, 5}, // offset past the end
+    {0, 0, 3, 0, 0},
+  }
+
+  for _, c := range cases {
+    from, to := pageBounds(c.n, c.offset, c.limit)
+    if from != c.from || to != c.to {
+      t.Errorf("pageBounds(%d, %d, %d) = %d, %d, want %d, %d", c.n, c.offset, c.limit, from, to, c.from, c.to)
+    }
+  }
+}
+
+func TestUserVisitsOrderPage(t *testing.T) {
+  visits := func() []UserVisit {
+    return []UserVisit{
+      {ID: 1, VisitedAt: 300, Mark: 5, Distance: 10, Place: "Б"},
+      {ID: 2, VisitedAt: 100, Mark: 3, Distance: 30, Place: "А"},
+      {ID: 3, VisitedAt: 200, Mark: 5, Distance: 20, Place: "В"},
+      {ID: 4, VisitedAt: 200, Mark: 5, Distance: 20, Place: "А"},
+      {ID: 5, VisitedAt: 400, Mark: 1, Distance: 10, Place: "Б"},
+    }
+  }
+
+  cases := []struct {
+    query string
+    ids   []int
+    err   *APIError
+  }{
+    {"", []int{2, 3, 4, 1, 5}, nil},
+    {"order=desc", []int{5, 1, 4, 3, 2}, nil},
+    {"sort=mark", []int{5, 2, 3, 4, 1}, nil},
+    // Tied marks stay ordered by date and id, reversed along with the key
+    {"sort=mark&order=desc", []int{1, 4, 3, 2, 5}, nil},
+    {"sort=distance", []int{1, 5, 3, 4, 2}, nil},
+    {"sort=place", []int{2, 4, 1, 5, 3}, nil},
+    {"limit=2", []int{2, 3}, nil},
+    {"offset=3&limit=10", []int{1, 5}, nil},
+    {"offset=5", []int{}, nil},
+    {"offset=7&limit=1", []int{}, nil},
+    {"sort=mark&order=desc&offset=1&limit=2", []int{4, 3}, nil},
+    {"limit=0", nil, badParam("limit")},
+    {"limit=-1", nil, badParam("limit")},
+    {"offset=-1", nil, badParam("offset")},
+    {"sort=age", nil, badParam("sort")},
+    {"order=up", nil, badParam("order")},
+  }
+
+  for _, c := range cases {
+    var args fasthttp.Args
+    args.Parse(c.query)
+
+    o, err := ParseUserVisitsOrder(&args)
+    if !reflect.DeepEqual(err, c.err) {
+      t.Errorf("%q: error %v, want %v", c.query, err, c.err)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+
+    ids := []int{}
+    for _, v := range o.Page(visits()) {
+      ids = append(ids, v.ID)
+    }
+    if !reflect.DeepEqual(ids, c.ids) {
+      t.Errorf("%q: %v, want %v", c.query, ids, c.ids)
+    }
+  }
+}
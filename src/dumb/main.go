@@ -9,7 +9,6 @@ import (
   "strings"
   "io/ioutil"
   "strconv"
-  "sort"
   "time"
   "github.com/valyala/fasthttp"
   "sync"
@@ -50,9 +49,25 @@ type Visit struct {
   Mark       *int   `json:"mark"`
 }
 
+type AgeOut struct {
+  Years        int    `json:"years"`
+  Months       int    `json:"months"`
+  Days         int    `json:"days"`
+  NextBirthday int64  `json:"next_birthday"`
+}
+
+// User with the optional parts requested by /users/:id?expand=
+type UserOut struct {
+  User
+  Age        *AgeOut      `json:"age,omitempty"`
+  EmailStatus *EmailStatus `json:"email_status,omitempty"`
+}
+
 type UserVisit struct {
   ID         int
+  LocationID int
   Place      string
+  City       string
   Country    string
   Distance   int
   Gender     string
@@ -62,15 +77,20 @@ type UserVisit struct {
 }
 
 type UserVisitOut struct {
-  Place      string `json:"place"`
-  VisitedAt  int64  `json:"visited_at"`
-  Mark       int    `json:"mark"`
+  Place      string  `json:"place"`
+  VisitedAt  int64   `json:"visited_at"`
+  Mark       int     `json:"mark"`
+
+  // Optional, see UserVisitFields
+  ID         *int    `json:"id,omitempty"`
+  Location   *int    `json:"location,omitempty"`
+  City       *string `json:"city,omitempty"`
+  Country    *string `json:"country,omitempty"`
+  Distance   *int    `json:"distance,omitempty"`
 }
 
 type VisitsType []Visit
 
-type UserVisitsType []UserVisitOut
-
 type Visits struct {
   Visits     VisitsType `json:"visits"`
 }
@@ -91,16 +111,6 @@ func (p Visit) toString() string {
   return toJson(p)
 }
 
-func (s UserVisitsType) Len() int {
-    return len(s)
-}
-func (s UserVisitsType) Swap(i, j int) {
-    s[i], s[j] = s[j], s[i]
-}
-func (s UserVisitsType) Less(i, j int) bool {
-    return s[i].VisitedAt < s[j].VisitedAt
-}
-
 func toJson(p interface{}) string {
   bytes, err := json.Marshal(p)
   if err != nil {
@@ -112,7 +122,7 @@ func toJson(p interface{}) string {
 }
 
 var hlUsersData = make(map[int]User)
-var hlUsersEmails = make(map[string]int)
+var hlUsersEmails = make(map[string]int) // keyed by NormalizeEmail
 var hlLocationsData = make(map[int]Location)
 var hlVisitsData = make(map[int]*Visit)
 var hlVisitsByUser = make(map[int][]int)
@@ -126,52 +136,69 @@ var hlVisitsByLocMutex sync.Mutex
 
 var emptyResponse = []byte("")
 
-func UserValidate(u User, id int) (bool) {
-  if u.Gender != "" && u.Gender != "m" && u.Gender != "f" {
-    // Sorry LGBTQ
-    return false
-  }
+// Set from EMAIL_VERIFY in main, format check only by default
+var emailVerifier EmailVerifier = FormatVerifier{}
 
-  if len(u.FirstName) >= 50 {
-    return false
+// UserValidate does the checks userRules can't express, on the user as it
+// will be stored. The email checks only run when verifyEmail is set, for new
+// or changed addresses: the verifier may go to the network, and users already
+// on a domain blocked later can still edit the rest of their profile.
+func UserValidate(u User, verifyEmail bool) *APIError {
+  if !verifyEmail {
+    return nil
   }
 
-  if len(u.LastName) >= 50 {
-    return false
+  emailErr := emailVerifier.Verify(u.Email)
+  if emailErr != nil {
+    return badField("email", "email is not valid: " + emailErr.Error())
   }
 
-  if len(u.Email) >= 100 {
-    return false
+  domainErr := CheckEmailDomain(u.Email)
+  if domainErr != nil {
+    return errDomainBlocked
   }
 
-  emailErr := ValidateFormat(u.Email)
-  if emailErr != nil {
-    return false
-  }
+  return nil
+}
+
+// emailTaken reports whether email belongs to a user other than id.
+// Callers hold hlUsersMutex.
+func emailTaken(email string, id int) bool {
+  emailID, ok := hlUsersEmails[NormalizeEmail(email)]
+  return ok && emailID != id
+}
 
-  if emailID, ok := hlUsersEmails[u.Email]; ok {
-    if emailID != id {
-      return false
+// storeUser saves u and points its email at it in hlUsersEmails, releasing
+// the user's previous address. Callers hold hlUsersMutex.
+func storeUser(u User) {
+  if existingUser, ok := hlUsersData[u.ID]; ok {
+    oldKey := NormalizeEmail(existingUser.Email)
+    if hlUsersEmails[oldKey] == u.ID {
+      delete(hlUsersEmails, oldKey)
     }
   }
 
-  return true
+  hlUsersData[u.ID] = u
+  hlUsersEmails[NormalizeEmail(u.Email)] = u.ID
 }
 
 func UsersHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
   body := ctx.PostBody()
 
-  if strings.Contains(string(body), "null") { // TODO: hack :(
-    return 400, emptyResponse
+  apiErr := ValidateBody(body, userRules, id == -1)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
   var u User
   err := json.Unmarshal(body, &u)
 
   if err != nil {
-    return 400, emptyResponse
+    return errorResponse(400, errInvalidJSON)
   }
+  normalizeUser(&u)
 
+  verifyEmail := true
   if id != -1 {
     existingUser := hlUsersData[id]
     if u.BirthDate == 0 { u.BirthDate = existingUser.BirthDate }
@@ -179,118 +206,191 @@ func UsersHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
     if u.FirstName == "" { u.FirstName = existingUser.FirstName }
     if u.LastName == "" { u.LastName = existingUser.LastName }
     if u.Email == "" { u.Email = existingUser.Email }
+    verifyEmail = u.Email != existingUser.Email
   }
 
-  if UserValidate(u, id) {
+  validateErr := UserValidate(u, verifyEmail)
+  if validateErr == nil {
     if id != -1 {
       if u.ID != 0 {
-        return 400, emptyResponse
+        return errorResponse(400, errIDNotAllowed)
       }
       u.ID = id
 
+      // Uniqueness check and both writes happen under one lock
       hlUsersMutex.Lock()
-      hlUsersData[id] = u
-      hlUsersEmails[u.Email] = id
+      if emailTaken(u.Email, id) {
+        hlUsersMutex.Unlock()
+        return errorResponse(400, errEmailTaken)
+      }
+
+      // Visit updates read the user under hlVisitsMutex to take their marks
+      // out of the aggregates, so the stored user and the buckets its visits
+      // are in change together
+      hlVisitsMutex.Lock()
+      existingUser := hlUsersData[id]
+      storeUser(u)
+
+      if u.Gender != existingUser.Gender || birthYear(&u) != birthYear(&existingUser) {
+        // Re-bucket this user's visits in the location aggregates
+        for _, vID := range hlVisitsByUser[id] {
+          v := hlVisitsData[vID]
+          locationAggApply(v, &existingUser, -1)
+          locationAggApply(v, &u, 1)
+        }
+      }
+      hlVisitsMutex.Unlock()
       hlUsersMutex.Unlock()
+
+      if u.Email != existingUser.Email {
+        QueueEmailCheck(id, u.Email)
+      }
       return 200, []byte("{}")
     } else {
       if u.ID == 0 {
-        return 400, emptyResponse
+        return errorResponse(400, errIDRequired)
       }
 
+      hlUsersMutex.Lock()
       if _, ok := hlUsersData[u.ID]; ok {
-        return 400, emptyResponse
+        hlUsersMutex.Unlock()
+        return errorResponse(400, errIDExists)
+      } else if emailTaken(u.Email, u.ID) {
+        hlUsersMutex.Unlock()
+        return errorResponse(400, errEmailTaken)
       } else {
-        hlUsersMutex.Lock()
-        hlUsersData[u.ID] = u
-        hlUsersEmails[u.Email] = u.ID
+        storeUser(u)
         hlUsersMutex.Unlock()
+
+        QueueEmailCheck(u.ID, u.Email)
         return 200, []byte("{}")
       }
     }
   } else {
-    return 400, emptyResponse
+    return errorResponse(400, validateErr)
+  }
+}
+
+func UsersHandlerGET(ctx *fasthttp.RequestCtx, u User) (int, []byte) {
+  params := ctx.QueryArgs()
+
+  if !params.Has("expand") {
+    return 200, []byte(toJson(u))
+  }
+
+  out := UserOut{User: u}
+
+  for _, e := range strings.Split(string(params.Peek("expand")), ",") {
+    switch e {
+    case "age":
+      birth := time.Unix(u.BirthDate, 0).In(AgeLocation)
+      now := time.Now().In(AgeLocation)
+      years, months, days := AgeDetailAt(birth, now)
+      out.Age = &AgeOut{years, months, days, NextBirthdayAt(birth, now).Unix()}
+    case "email_status":
+      status := GetEmailStatus(u.ID)
+      out.EmailStatus = &status
+    default:
+      return errorResponse(400, badParam("expand"))
+    }
+  }
+
+  return 200, []byte(toJson(out))
+}
+
+func UsersHandlerGETByEmail(ctx *fasthttp.RequestCtx, email string) (int, []byte) {
+  hlUsersMutex.Lock()
+  id, ok := hlUsersEmails[NormalizeEmail(email)]
+  u := hlUsersData[id]
+  hlUsersMutex.Unlock()
+
+  if !ok {
+    return notFoundResponse()
   }
+  return UsersHandlerGET(ctx, u)
 }
 
 func UsersHandlerGETVisits(ctx *fasthttp.RequestCtx, uid int) (int, []byte) {
   visitIds := hlVisitsByUser[uid]
-  visitsOut := make([]UserVisitOut, 0)
+  visits := make([]UserVisit, 0)
 
   params := ctx.QueryArgs()
 
-  if params.Has("fromDate") {
-    p0, err := strconv.Atoi(string(params.Peek("fromDate")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
+  filter, apiErr := ParseUserVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
-  if params.Has("toDate") {
-    p0, err := strconv.Atoi(string(params.Peek("toDate")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
+  order, apiErr := ParseUserVisitsOrder(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
-  if params.Has("toDistance") {
-    p0, err := strconv.Atoi(string(params.Peek("toDistance")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
+  fields, apiErr := ParseUserVisitFields(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
   for _, vID := range visitIds {
     v := hlVisitsData[vID]
+    l := hlLocationsData[v.Location]
 
-    shoudlInclude := true
-
-    if shoudlInclude && params.Has("fromDate") {
-      p0, _ := strconv.Atoi(string(params.Peek("fromDate")))
-      shoudlInclude = shoudlInclude && v.VisitedAt > int64(p0)
+    if filter.Match(v, &l) {
+      uv := UserVisit{ID: v.ID, LocationID: v.Location, Place: l.Place, City: l.City, Country: l.Country, Distance: l.Distance, VisitedAt: v.VisitedAt, Mark: *v.Mark}
+      visits = append(visits, uv)
     }
+  }
 
-    if shoudlInclude && params.Has("toDate") {
-      p0, _ := strconv.Atoi(string(params.Peek("toDate")))
-      shoudlInclude = shoudlInclude && v.VisitedAt < int64(p0)
-    }
+  visits = order.Page(visits)
 
-    l := hlLocationsData[v.Location]
-    if shoudlInclude && params.Has("country") {
-      p0 := string(params.Peek("country"))
-      shoudlInclude = shoudlInclude && l.Country == p0
-    }
+  visitsOut := make([]UserVisitOut, len(visits))
+  for i := range visits {
+    visitsOut[i] = fields.Out(&visits[i])
+  }
 
-    if shoudlInclude && params.Has("toDistance") {
-      p0, _ := strconv.Atoi(string(params.Peek("toDistance")))
-      shoudlInclude = shoudlInclude && l.Distance < p0
-    }
+  vos := VisitsOut{visitsOut}
+  return 200, []byte(toJson(vos))
+}
 
-    if shoudlInclude {
-      uvo := UserVisitOut{l.Place, v.VisitedAt, *v.Mark}
-      visitsOut = append(visitsOut, uvo)
-    }
+func UsersHandlerGETAvg(ctx *fasthttp.RequestCtx, uid int) (int, []byte) {
+  visitIDs := hlVisitsByUser[uid]
+
+  total := 0
+  cnt := 0
+
+  filter, apiErr := ParseUserVisitsFilter(ctx.QueryArgs())
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
-  sort.Sort(UserVisitsType(visitsOut))
+  for _, vID := range visitIDs {
+    v := hlVisitsData[vID]
+    l := hlLocationsData[v.Location]
 
-  vos := VisitsOut{visitsOut}
-  return 200, []byte(toJson(vos))
+    if filter.Match(v, &l) {
+      total += int(*v.Mark)
+      cnt += 1
+    }
+  }
+
+  return 200, avgResponse(total, cnt)
 }
 
 func LocationsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
   body := ctx.PostBody()
 
-  if strings.Contains(string(body), "null") { // TODO: hack :(
-    return 400, emptyResponse
+  apiErr := ValidateBody(body, locationRules, id == -1)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
   var l Location
   err := json.Unmarshal(body, &l)
 
   if err != nil {
-    return 400, emptyResponse
+    return errorResponse(400, errInvalidJSON)
   }
+  normalizeLocation(&l)
 
   if id != -1 {
     existingLoc := hlLocationsData[id]
@@ -300,17 +400,9 @@ func LocationsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
     if l.City == "" { l.City = existingLoc.City }
   }
 
-  if len(l.Country) >= 50 {
-    return 400, emptyResponse
-  }
-
-  if len(l.City) >= 50 {
-    return 400, emptyResponse
-  }
-
   if id != -1 {
     if l.ID != 0 {
-      return 400, emptyResponse
+      return errorResponse(400, errIDNotAllowed)
     }
     l.ID = id
 
@@ -321,11 +413,11 @@ func LocationsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
   } else {
     locID := l.ID
     if locID == 0 {
-      return 400, emptyResponse
+      return errorResponse(400, errIDRequired)
     }
 
     if _, ok := hlLocationsData[locID]; ok {
-      return 400, emptyResponse
+      return errorResponse(400, errIDExists)
     } else {
       hlLocationsMutex.Lock()
       hlLocationsData[locID] = l
@@ -336,138 +428,68 @@ func LocationsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
 }
 
 func LocationsHandlerGETAvg(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
-  visitIDs := hlVisitsByLoc[lid]
-
-  params := ctx.QueryArgs()
-  total := 0
-  cnt := 0
-
-  if params.Has("fromDate") {
-    p0, err := strconv.Atoi(string(params.Peek("fromDate")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
-  }
-
-  if params.Has("toDate") {
-    p0, err := strconv.Atoi(string(params.Peek("toDate")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
-  }
-
-  if params.Has("fromAge") {
-    p0, err := strconv.Atoi(string(params.Peek("fromAge")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
+  if ctx.QueryArgs().Has("groupBy") {
+    return LocationsHandlerGETAvgGrouped(ctx, lid)
   }
 
-  if params.Has("toAge") {
-    p0, err := strconv.Atoi(string(params.Peek("toAge")))
-    if err != nil || p0 == 0 {
-      return 400, emptyResponse
-    }
-  }
-
-  if params.Has("gender") {
-    p0 := string(params.Peek("gender"))
-    if p0 != "m" && p0 != "f" {
-      return 400, emptyResponse
-    }
+  filter, apiErr := ParseLocationVisitsFilter(ctx.QueryArgs())
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
+  total, cnt := locationMarks(lid, &filter)
 
-  for _, vID := range visitIDs {
-    v := hlVisitsData[vID]
-
-    shoudlInclude := true
-
-    if params.Has("fromDate") {
-      p0, _ := strconv.Atoi(string(params.Peek("fromDate")))
-      shoudlInclude = shoudlInclude && v.VisitedAt > int64(p0)
-    }
-
-    if params.Has("toDate") {
-      p0, _ := strconv.Atoi(string(params.Peek("toDate")))
-      shoudlInclude = shoudlInclude && v.VisitedAt < int64(p0)
-    }
-
-    u := hlUsersData[v.User]
-    age := Age(time.Unix(u.BirthDate, 0))
-
-    if params.Has("fromAge") {
-      p0, _ := strconv.Atoi(string(params.Peek("fromAge")))
-
-      shoudlInclude = shoudlInclude && age >= int(p0)
-    }
-
-    if params.Has("toAge") {
-      p0, _ := strconv.Atoi(string(params.Peek("toAge")))
-
-      shoudlInclude = shoudlInclude && age < int(p0)
-    }
-
-    if params.Has("gender") {
-      p0 := string(params.Peek("gender"))
-      shoudlInclude = shoudlInclude && u.Gender == p0
-    }
-
-    if shoudlInclude {
-      total += int(*v.Mark)
-      cnt += 1
-    }
-  }
+  return 200, avgResponse(total, cnt)
+}
 
+// avgResponse rounds like /stats and the grouped /avg do, see round5
+func avgResponse(total int, cnt int) []byte {
   var avg float64
   if cnt == 0 {
     avg = 0.0
   } else {
-    avg = (float64(total) / float64(cnt)) + 0.000005
+    avg = round5(float64(total) / float64(cnt))
   }
-  return 200, []byte("{\"avg\": " + strconv.FormatFloat(avg, 'f', 5, 64) + "}")
+  return []byte("{\"avg\": " + strconv.FormatFloat(avg, 'f', 5, 64) + "}")
 }
 
 func VisitsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
   body := ctx.PostBody()
 
-  if strings.Contains(string(body), "null") { // TODO: hack :(
-    return 400, emptyResponse
+  apiErr := ValidateBody(body, visitRules, id == -1)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
   }
 
   var v Visit
   err := json.Unmarshal(body, &v)
 
   if err != nil {
-    return 400, emptyResponse
+    return errorResponse(400, errInvalidJSON)
   }
 
   if v.Location > 0 {
     if _, ok := hlLocationsData[v.Location]; !ok {
-      return 400, emptyResponse
+      return errorResponse(400, unknownReference("location"))
     }
   }
 
   if v.User > 0 {
     if _, ok := hlUsersData[v.User]; !ok {
-      return 400, emptyResponse
+      return errorResponse(400, unknownReference("user"))
     }
   }
 
-  if v.Mark != nil && *v.Mark > 5 {
-    return 400, emptyResponse
-  }
-
-  if v.Mark == nil && id == -1 {
-    return 400, emptyResponse
-  }
-
   if id != -1 {
     if v.ID != 0 {
-      return 400, emptyResponse
+      return errorResponse(400, errIDNotAllowed)
     }
 
+    // The visit is changed in place, updates of it go one at a time
+    hlVisitsMutex.Lock()
     existingVisit := hlVisitsData[id]
+    oldUser := hlUsersData[existingVisit.User]
+    locationAggApply(existingVisit, &oldUser, -1)
 
     if v.VisitedAt != 0 && v.VisitedAt != existingVisit.VisitedAt { existingVisit.VisitedAt = v.VisitedAt }
 
@@ -495,20 +517,24 @@ func VisitsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
     }
 
     hlVisitsData[id] = existingVisit
+    u := hlUsersData[existingVisit.User]
+    locationAggApply(existingVisit, &u, 1)
+    hlVisitsMutex.Unlock()
 
     return 200, []byte("{}")
   } else {
     newId := v.ID
     if newId == 0 {
-      return 400, emptyResponse
+      return errorResponse(400, errIDRequired)
     }
 
     if _, ok := hlVisitsData[newId]; ok {
-      return 400, emptyResponse
+      return errorResponse(400, errIDExists)
     } else {
+      // Held until the aggregates have the visit too, so RebuildLocationAggs
+      // counts it exactly once
       hlVisitsMutex.Lock()
       hlVisitsData[newId] = &v
-      hlVisitsMutex.Unlock()
 
       userId := v.User
       hlVisitsByUserMutex.Lock()
@@ -519,6 +545,10 @@ func VisitsHandlerPOST(ctx *fasthttp.RequestCtx, id int) (int, []byte) {
       hlVisitsByLocMutex.Lock()
       hlVisitsByLoc[locId] = append(hlVisitsByLoc[locId], newId)
       hlVisitsByLocMutex.Unlock()
+
+      u := hlUsersData[v.User]
+      locationAggApply(&v, &u, 1)
+      hlVisitsMutex.Unlock()
       return 200, []byte("{}")
     }
   }
@@ -564,94 +594,110 @@ func removeFromUsers(oldId int, existingVisit *Visit) {
   hlVisitsByUserMutex.Unlock()
 }
 
-func GenericHandler(ctx *fasthttp.RequestCtx) {
-  path := string(ctx.Path())
-  pathBits := strings.Split(path, "/")
-  status, body := 400, emptyResponse
-  methodPost := ctx.IsPost()
-
-  if len(pathBits) < 3 || len(pathBits) > 4 {
-    status, body = 404, emptyResponse
-  } else {
-    objType := pathBits[1]
-    sid := pathBits[2]
-    iid, err := strconv.Atoi(sid)
-    if err != nil {
-      if objType == "users" && sid == "new" && methodPost {
-        status, body = UsersHandlerPOST(ctx, -1)
-      } else if objType == "locations" && sid == "new" && methodPost {
-        status, body = LocationsHandlerPOST(ctx, -1)
-      } else if objType == "visits" && sid == "new" && methodPost {
-        status, body = VisitsHandlerPOST(ctx, -1)
-      } else {
-        status, body = 404, emptyResponse
-      }
-
-    } else {
-      if objType == "users" {
-        if u, ok := hlUsersData[iid]; ok {
-          if len(pathBits) == 4 {
-            if pathBits[3] == "visits" {
-              status, body = UsersHandlerGETVisits(ctx, iid)
-            } else {
-              status, body = 404, emptyResponse
-            }
-          } else {
-            if methodPost {
-              hlUsersMutex.Lock()
-              status, body = UsersHandlerPOST(ctx, iid)
-              hlUsersMutex.Unlock()
-            } else {
-              status, body = 200, []byte(toJson(u))
-            }
-          }
-        } else {
-          status, body = 404, emptyResponse
-        }
-      } else if objType == "locations" {
-        if l, ok := hlLocationsData[iid]; ok {
-          if len(pathBits) == 4 {
-            if pathBits[3] == "avg" {
-              status, body = LocationsHandlerGETAvg(ctx, iid)
-            } else {
-              status, body = 404, emptyResponse
-            }
-          } else {
-            if methodPost {
-              hlLocationsMutex.Lock()
-              status, body = LocationsHandlerPOST(ctx, iid)
-              hlLocationsMutex.Unlock()
-            } else {
-              status, body = 200, []byte(toJson(l))
-            }
-          }
-        } else {
-          status, body = 404, emptyResponse
-        }
-      } else if objType == "visits" {
-        if v, ok := hlVisitsData[iid]; ok {
-          if len(pathBits) == 4 {
-            status, body = 404, emptyResponse
-          } else {
-            if methodPost {
-              hlVisitsMutex.Lock()
-              status, body = VisitsHandlerPOST(ctx, iid)
-              hlVisitsMutex.Unlock()
-            } else {
-              status, body = 200, []byte(toJson(v))
-            }
-        }
-        } else {
-          status, body = 404, emptyResponse
-        }
-      }
+// withID resolves the :id param of an entity route, unknown ids are 404.
+func withID(exists func(id int) bool, h func(ctx *fasthttp.RequestCtx, id int) (int, []byte)) RouteHandler {
+  return func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    id, ok := p.Int(0)
+    if !ok || !exists(id) {
+      return notFoundResponse()
     }
+    return h(ctx, id)
   }
+}
+
+func userExists(id int) bool {
+  _, ok := hlUsersData[id]
+  return ok
+}
+
+func locationExists(id int) bool {
+  _, ok := hlLocationsData[id]
+  return ok
+}
+
+func visitExists(id int) bool {
+  _, ok := hlVisitsData[id]
+  return ok
+}
+
+func UsersHandlerGETByID(ctx *fasthttp.RequestCtx, uid int) (int, []byte) {
+  return UsersHandlerGET(ctx, hlUsersData[uid])
+}
+
+func LocationsHandlerGET(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  return 200, []byte(toJson(hlLocationsData[lid]))
+}
+
+func VisitsHandlerGET(ctx *fasthttp.RequestCtx, vid int) (int, []byte) {
+  return 200, []byte(toJson(hlVisitsData[vid]))
+}
+
+func NewAPIRouter() *Router {
+  r := &Router{}
+
+  r.GET("/schema", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return SchemaHandlerGET(ctx)
+  })
+
+  // Not split, the address itself may contain "/"
+  r.GET("/users/by-email/*email", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return UsersHandlerGETByEmail(ctx, p.String(0))
+  })
+  r.POST("/users/new", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return UsersHandlerPOST(ctx, -1)
+  })
+  r.GET("/users/:id", withID(userExists, UsersHandlerGETByID))
+  r.POST("/users/:id", withID(userExists, UsersHandlerPOST))
+  r.GET("/users/:id/visits", withID(userExists, UsersHandlerGETVisits))
+  r.GET("/users/:id/avg", withID(userExists, UsersHandlerGETAvg))
+  r.GET("/users/:id/timeline", withID(userExists, UsersHandlerGETTimeline))
+
+  r.POST("/locations/new", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return LocationsHandlerPOST(ctx, -1)
+  })
+  r.GET("/locations/top", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return LocationsHandlerGETTop(ctx)
+  })
+  r.GET("/locations/:id", withID(locationExists, LocationsHandlerGET))
+  r.POST("/locations/:id", withID(locationExists, LocationsHandlerPOST))
+  r.GET("/locations/:id/avg", withID(locationExists, LocationsHandlerGETAvg))
+  r.GET("/locations/:id/stats", withID(locationExists, LocationsHandlerGETStats))
+  r.GET("/locations/:id/visitors", withID(locationExists, LocationsHandlerGETVisitors))
+  r.GET("/locations/:id/timeline", withID(locationExists, LocationsHandlerGETTimeline))
+  r.GET("/locations/:id/demographics", withID(locationExists, LocationsHandlerGETDemographics))
+
+  r.POST("/visits/new", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+    return VisitsHandlerPOST(ctx, -1)
+  })
+  r.GET("/visits/:id", withID(visitExists, VisitsHandlerGET))
+  r.POST("/visits/:id", withID(visitExists, VisitsHandlerPOST))
+
+  for _, byCity := range []bool{false, true} {
+    byCity := byCity
+    prefix := "/countries"
+    if byCity {
+      prefix = "/cities"
+    }
+    r.GET(prefix, func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+      return RegionsHandlerGET(ctx, byCity)
+    })
+    r.GET(prefix + "/:name/avg", func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+      return RegionsHandlerGETAvg(ctx, p.String(0), byCity)
+    })
+  }
+
+  return r
+}
+
+var apiRouter = NewAPIRouter()
+
+func GenericHandler(ctx *fasthttp.RequestCtx) {
+  status, body := apiRouter.Dispatch(ctx)
 
   ctx.SetStatusCode(status)
   ctx.Write(body)
 
-  if methodPost {
+  if ctx.IsPost() {
     ctx.SetConnectionClose()
   }
 }
@@ -675,8 +721,9 @@ func LoadUsers(r *zip.ReadCloser) {
 
       for _, v := range users.Users {
         id := v.ID
+        normalizeUser(&v)
         hlUsersData[id] = v
-        hlUsersEmails[v.Email] = id
+        hlUsersEmails[NormalizeEmail(v.Email)] = id
       }
 
       println("Loaded users: " + strconv.Itoa(len(users.Users)))
@@ -705,6 +752,7 @@ func LoadLocations(r *zip.ReadCloser) {
       rc.Close()
 
       for _, v := range locations.Locations {
+        normalizeLocation(&v)
         hlLocationsData[v.ID] = v
       }
 
@@ -758,14 +806,77 @@ func LoadVisitsFile(f *zip.File, start time.Time) {
 func LoadVisits(r *zip.ReadCloser) {
   start := time.Now()
 
+  var wg sync.WaitGroup
   for _, f := range r.File {
     if strings.HasPrefix(f.Name, "visits_") {
-      go LoadVisitsFile(f, start)
+      wg.Add(1)
+      go func(f *zip.File) {
+        LoadVisitsFile(f, start)
+        wg.Done()
+      }(f)
     }
   }
+  wg.Wait()
 }
 
 func main () {
+  // COMPAT_EMPTY_ERRORS=1 answers failures with an empty body, as before
+  if compat := os.Getenv("COMPAT_EMPTY_ERRORS"); compat != "" {
+    on, err := strconv.ParseBool(compat)
+    if err != nil {
+      log.Fatal(err)
+    }
+    compatEmptyErrors = on
+  }
+
+  // Timezone for birthdays, UTC unless set
+  if tz := os.Getenv("AGE_TZ"); tz != "" {
+    loc, err := time.LoadLocation(tz)
+    if err != nil {
+      log.Fatal(err)
+    }
+    AgeLocation = loc
+  }
+
+  // Email checks: EMAIL_VERIFY=format|mx|smtp, EMAIL_HELO, EMAIL_FROM, EMAIL_TIMEOUT
+  if helo := os.Getenv("EMAIL_HELO"); helo != "" {
+    DefaultSMTPVerifier.HelloName = helo
+  }
+  if from := os.Getenv("EMAIL_FROM"); from != "" {
+    DefaultSMTPVerifier.MailFrom = from
+  }
+  if timeout := os.Getenv("EMAIL_TIMEOUT"); timeout != "" {
+    d, err := time.ParseDuration(timeout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    DefaultSMTPVerifier.Timeout = d
+  }
+  verifier, err := NewEmailVerifier(os.Getenv("EMAIL_VERIFY"))
+  if err != nil {
+    log.Fatal(err)
+  }
+  emailVerifier = verifier
+
+  // Blocked/allowed email domains, reloaded when the file changes
+  if policy := os.Getenv("EMAIL_DOMAIN_POLICY"); policy != "" {
+    err := WatchDomainPolicy(policy, 5 * time.Second)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  // Background deliverability checks: EMAIL_CHECK_WORKERS > 0 turns them on
+  if workers := os.Getenv("EMAIL_CHECK_WORKERS"); workers != "" {
+    n, err := strconv.Atoi(workers)
+    if err != nil {
+      log.Fatal(err)
+    }
+    if n > 0 {
+      StartEmailChecks(n, 10000, DefaultSMTPVerifier)
+    }
+  }
+
   println("Loading zip...")
 
   // Open a zip archive for reading.
@@ -779,9 +890,23 @@ func main () {
 
   // Iterate through the files in the archive,
   // printing some of their contents.
-  go LoadUsers(r)
+  var loading sync.WaitGroup
+  loading.Add(2)
+  go func() {
+    LoadUsers(r)
+    loading.Done()
+  }()
   go LoadLocations(r)
-  go LoadVisits(r)
+  go func() {
+    LoadVisits(r)
+    loading.Done()
+  }()
+
+  // Location aggregates need both users and visits
+  go func() {
+    loading.Wait()
+    RebuildLocationAggs()
+  }()
 
   port := os.Getenv("PORT")
   if port == "" {
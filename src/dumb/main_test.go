@@ -0,0 +1,87 @@
+package main
+
+import (
+  "encoding/json"
+  "testing"
+  "github.com/valyala/fasthttp"
+)
+
+func getUserByEmail(t *testing.T, email string) (int, int) {
+  var ctx fasthttp.RequestCtx
+  ctx.Request.Header.SetMethod("GET")
+  ctx.Request.SetRequestURI("/users/by-email/" + email)
+
+  status, body := apiRouter.Dispatch(&ctx)
+  if status != 200 {
+    return status, 0
+  }
+
+  var u User
+  if err := json.Unmarshal(body, &u); err != nil {
+    t.Fatalf("GET /users/by-email/%s: %s", email, err)
+  }
+  return status, u.ID
+}
+
+type emailLookup struct {
+  email  string
+  status int
+  id     int
+}
+
+// An address given up by one user can be claimed by another, and lookups by
+// email follow the change.
+func TestUsersEmailIndexFollowsChanges(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  posts := []struct {
+    id     int
+    body   string
+    status int
+  }{
+    {-1, `{"id": 1, "email": "anna@mail.ru", "first_name": "Анна", "last_name": "Иванова", "gender": "f", "birth_date": 0}`, 200},
+    {-1, `{"id": 2, "email": "boris@mail.ru", "first_name": "Борис", "last_name": "Петров", "gender": "m", "birth_date": 0}`, 200},
+    {2, `{"email": "anna@mail.ru"}`, 400},
+    {-1, `{"id": 3, "email": "Anna@MAIL.RU", "first_name": "Анна", "last_name": "Сидорова", "gender": "f", "birth_date": 0}`, 200},
+    {1, `{"email": "anna@кириллица.рф"}`, 200},
+  }
+
+  for _, p := range posts {
+    if status, out := testPOST(UsersHandlerPOST, p.id, p.body); status != p.status {
+      t.Fatalf("POST %d %s: %d %s, want %d", p.id, p.body, status, out, p.status)
+    }
+  }
+
+  check := func(step string, lookups []emailLookup) {
+    for _, l := range lookups {
+      status, id := getUserByEmail(t, l.email)
+      if status != l.status || id != l.id {
+        t.Errorf("%s: GET /users/by-email/%s = %d, user %d, want %d, user %d", step, l.email, status, id, l.status, l.id)
+      }
+    }
+  }
+
+  check("after user 1 changed email", []emailLookup{
+    {"anna@xn--80apaahia1b8c.xn--p1ai", 200, 1},
+    {"anna@Кириллица.РФ", 200, 1},
+    {"anna@mail.ru", 404, 0},
+    {"Anna@mail.ru", 200, 3}, // local parts are case-sensitive
+    {"boris@mail.ru", 200, 2},
+  })
+
+  // User 2 takes user 1's old address, and can't take the new one
+  if status, out := testPOST(UsersHandlerPOST, 2, `{"email": "anna@mail.ru"}`); status != 200 {
+    t.Fatalf("claiming the old address: %d %s", status, out)
+  }
+  if status, _ := testPOST(UsersHandlerPOST, 2, `{"email": "anna@кириллица.рф"}`); status != 400 {
+    t.Errorf("claiming the new address: %d, want 400", status)
+  }
+
+  check("after user 2 took the old address", []emailLookup{
+    {"anna@кириллица.рф", 200, 1},
+    {"anna@mail.ru", 200, 2},
+    {"Anna@mail.ru", 200, 3},
+    {"boris@mail.ru", 404, 0},
+  })
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+  "sort"
+  "github.com/valyala/fasthttp"
+  "golang.org/x/text/unicode/norm"
+)
+
+// Aggregates over Location.Country (/countries) and Location.City (/cities).
+// Cities are grouped by name only, two Санктгород in different countries
+// count as one.
+
+type RegionOut struct {
+  Name       string   `json:"name"`
+  Locations  int      `json:"locations"`
+  Count      int      `json:"count"`
+  Avg        float64  `json:"avg"`
+}
+
+type RegionsType []RegionOut
+
+type CountriesOut struct {
+  Countries  []RegionOut `json:"countries"`
+}
+
+type CitiesOut struct {
+  Cities     []RegionOut `json:"cities"`
+}
+
+func (s RegionsType) Len() int {
+  return len(s)
+}
+
+func (s RegionsType) Swap(i, j int) {
+  s[i], s[j] = s[j], s[i]
+}
+
+func (s RegionsType) Less(i, j int) bool {
+  return s[i].Name < s[j].Name
+}
+
+func regionName(l *Location, byCity bool) string {
+  if byCity {
+    return l.City
+  }
+  return l.Country
+}
+
+func RegionsHandlerGET(ctx *fasthttp.RequestCtx, byCity bool) (int, []byte) {
+  filter, apiErr := ParseLocationVisitsFilter(ctx.QueryArgs())
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  totals := make(map[string]*RegionOut)
+  sums := make(map[string]int)
+
+  hlLocationsMutex.Lock()
+  for lid, l := range hlLocationsData {
+    name := regionName(&l, byCity)
+    r, ok := totals[name]
+    if !ok {
+      r = &RegionOut{Name: name}
+      totals[name] = r
+    }
+
+    total, cnt := locationMarks(lid, &filter)
+    r.Locations += 1
+    r.Count += cnt
+    sums[name] += total
+  }
+  hlLocationsMutex.Unlock()
+
+  regions := make([]RegionOut, 0, len(totals))
+  for name, r := range totals {
+    if r.Count > 0 {
+      r.Avg = round5(float64(sums[name]) / float64(r.Count))
+    }
+    regions = append(regions, *r)
+  }
+
+  sort.Sort(RegionsType(regions))
+
+  if byCity {
+    return 200, []byte(toJson(CitiesOut{regions}))
+  }
+  return 200, []byte(toJson(CountriesOut{regions}))
+}
+
+// RegionsHandlerGETAvg answers /countries/:name/avg and /cities/:name/avg.
+// name comes from ctx.Path() and is already URL-decoded.
+func RegionsHandlerGETAvg(ctx *fasthttp.RequestCtx, name string, byCity bool) (int, []byte) {
+  filter, apiErr := ParseLocationVisitsFilter(ctx.QueryArgs())
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  name = norm.NFC.String(name)
+  found := false
+  total, cnt := 0, 0
+
+  hlLocationsMutex.Lock()
+  for lid, l := range hlLocationsData {
+    if regionName(&l, byCity) != name {
+      continue
+    }
+    found = true
+
+    t, c := locationMarks(lid, &filter)
+    total += t
+    cnt += c
+  }
+  hlLocationsMutex.Unlock()
+
+  if !found {
+    return notFoundResponse()
+  }
+
+  group := MarkGroup{Count: cnt}
+  if cnt > 0 {
+    group.Avg = round5(float64(total) / float64(cnt))
+  }
+  return 200, []byte(toJson(group))
+}
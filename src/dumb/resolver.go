@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the DNS records needed to find a domain's mail hosts.
+// Along with each answer, errors included, it says how long the answer may
+// be cached; zero means not at all.
+type Resolver interface {
+	LookupMX(domain string) ([]*net.MX, time.Duration, error)
+	LookupHost(domain string) ([]string, time.Duration, error)
+}
+
+// NetResolver queries a DNS server directly, so that answers carry the TTLs
+// of their records: the smallest TTL in the answer section, and for NXDOMAIN
+// and NODATA the SOA minimum from the authority section (RFC 2308), or
+// NegativeTTL when the server sends no SOA. Failures to get an answer
+// (SERVFAIL, timeouts) are not to be cached. Truncated UDP answers are asked
+// again over TCP.
+type NetResolver struct {
+	Server      string // host:port, the first nameserver in /etc/resolv.conf if empty
+	NegativeTTL time.Duration
+	Timeout     time.Duration
+}
+
+// dnsNotFound reports whether err is a definite answer that the name or the
+// record does not exist (NXDOMAIN, NODATA), as opposed to no answer at all
+// (SERVFAIL, timeouts).
+func dnsNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.Temporary() && !dnsErr.Timeout()
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, the
+// local host when there is none.
+func systemNameserver() string {
+	server := "127.0.0.1"
+
+	conf, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(conf), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+func (r NetResolver) server() string {
+	if r.Server != "" {
+		return r.Server
+	}
+	return systemNameserver()
+}
+
+func (r NetResolver) LookupMX(domain string) ([]*net.MX, time.Duration, error) {
+	answers, ttl, err := r.query(domain, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, ttl, err
+	}
+
+	mx := make([]*net.MX, 0, len(answers))
+	for _, a := range answers {
+		if body, ok := a.Body.(*dnsmessage.MXResource); ok {
+			mx = append(mx, &net.MX{Host: body.MX.String(), Pref: body.Pref})
+		}
+	}
+	return mx, ttl, nil
+}
+
+// LookupHost asks for A and AAAA records. The domain is found if either
+// has some, and the answer lives as long as the shorter-lived one. Without
+// addresses, a failure to get an answer outweighs a definite one.
+func (r NetResolver) LookupHost(domain string) ([]string, time.Duration, error) {
+	var addrs []string
+	var ttl, negativeTTL time.Duration
+	var notFound, failure error
+	found := false
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, qttl, err := r.query(domain, qtype)
+		if err != nil {
+			if !dnsNotFound(err) {
+				failure = err
+			} else if notFound == nil || qttl < negativeTTL {
+				notFound, negativeTTL = err, qttl
+			}
+			continue
+		}
+
+		for _, a := range answers {
+			switch body := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]).String())
+			}
+		}
+		if !found || qttl < ttl {
+			ttl = qttl
+		}
+		found = true
+	}
+
+	if found {
+		return addrs, ttl, nil
+	}
+	if failure != nil {
+		return nil, 0, failure
+	}
+	return nil, negativeTTL, notFound
+}
+
+// query returns the answer records of type qtype for domain and their TTL.
+func (r NetResolver) query(domain string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	server := r.server()
+	notFound := &net.DNSError{Err: "no such host", Name: domain, Server: server}
+
+	fqdn := domain
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, r.NegativeTTL, notFound
+	}
+
+	id := uint16(rand.Uint32())
+	question := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := question.Pack()
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: domain, Server: server}
+	}
+
+	msg, err := r.exchange("udp", server, packet, id)
+	if err == nil && msg.Header.Truncated {
+		msg, err = r.exchange("tcp", server, packet, id)
+	}
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: domain, Server: server, IsTemporary: true}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			dnsErr.IsTimeout = true
+		}
+		return nil, 0, dnsErr
+	}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, r.negativeTTL(msg), notFound
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + msg.Header.RCode.String(), Name: domain, Server: server, IsTemporary: true}
+	}
+
+	// CNAMEs on the way count towards the TTL
+	var answers []dnsmessage.Resource
+	var ttl uint32
+	for i, a := range msg.Answers {
+		if i == 0 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+		if a.Header.Type == qtype {
+			answers = append(answers, a)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, r.negativeTTL(msg), notFound
+	}
+	return answers, time.Duration(ttl) * time.Second, nil
+}
+
+// negativeTTL is how long a NXDOMAIN or NODATA answer may be cached.
+func (r NetResolver) negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, a := range msg.Authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			ttl := a.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return r.NegativeTTL
+}
+
+// exchange sends packet to server over network ("udp" or "tcp") and returns
+// the response with the same id.
+func (r NetResolver) exchange(network string, server string, packet []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if r.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(r.Timeout))
+	}
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed by their length
+		framed := make([]byte, 2+len(packet))
+		binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+		copy(framed[2:], packet)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(buf, id)
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Stray answers to earlier queries are skipped
+		msg, err := parseDNSResponse(buf[:n], id)
+		if err == nil {
+			return msg, nil
+		}
+	}
+}
+
+var errDNSBadResponse = errors.New("malformed DNS response")
+
+func parseDNSResponse(buf []byte, id uint16) (*dnsmessage.Message, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, errDNSBadResponse
+	}
+	if !msg.Header.Response || msg.Header.ID != id {
+		return nil, errDNSBadResponse
+	}
+	return &msg, nil
+}
+
+type resolverCacheEntry struct {
+	mx      []*net.MX
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// CachingResolver keeps answers of another Resolver for as long as their
+// TTL allows, failures included. Expired entries are swept out at most every
+// resolverSweepInterval, when answers are stored, so domains looked up only
+// once don't stay cached for the life of the process.
+type CachingResolver struct {
+	Resolver Resolver
+
+	mu        sync.Mutex
+	mx        map[string]resolverCacheEntry
+	hosts     map[string]resolverCacheEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+const resolverSweepInterval = time.Minute
+
+func NewCachingResolver(r Resolver) *CachingResolver {
+	return &CachingResolver{
+		Resolver: r,
+		mx:       make(map[string]resolverCacheEntry),
+		hosts:    make(map[string]resolverCacheEntry),
+		now:      time.Now,
+	}
+}
+
+// sweep drops expired entries from both caches. Callers hold c.mu.
+func (c *CachingResolver) sweep(now time.Time) {
+	for _, cache := range []map[string]resolverCacheEntry{c.mx, c.hosts} {
+		for domain, entry := range cache {
+			if !now.Before(entry.expires) {
+				delete(cache, domain)
+			}
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *CachingResolver) lookup(cache map[string]resolverCacheEntry, domain string, fetch func() resolverCacheEntry) resolverCacheEntry {
+	c.mu.Lock()
+	entry, ok := cache[domain]
+	c.mu.Unlock()
+
+	if ok && c.now().Before(entry.expires) {
+		return entry
+	}
+
+	entry = fetch()
+
+	now := c.now()
+	c.mu.Lock()
+	if entry.expires.After(now) {
+		cache[domain] = entry
+	} else {
+		delete(cache, domain)
+	}
+	if now.Sub(c.lastSweep) >= resolverSweepInterval {
+		c.sweep(now)
+	}
+	c.mu.Unlock()
+
+	return entry
+}
+
+func (c *CachingResolver) LookupMX(domain string) ([]*net.MX, time.Duration, error) {
+	entry := c.lookup(c.mx, domain, func() resolverCacheEntry {
+		mx, ttl, err := c.Resolver.LookupMX(domain)
+		return resolverCacheEntry{mx: mx, err: err, expires: c.now().Add(ttl)}
+	})
+	return entry.mx, entry.expires.Sub(c.now()), entry.err
+}
+
+func (c *CachingResolver) LookupHost(domain string) ([]string, time.Duration, error) {
+	entry := c.lookup(c.hosts, domain, func() resolverCacheEntry {
+		addrs, ttl, err := c.Resolver.LookupHost(domain)
+		return resolverCacheEntry{addrs: addrs, err: err, expires: c.now().Add(ttl)}
+	})
+	return entry.addrs, entry.expires.Sub(c.now()), entry.err
+}
+
+// DefaultResolver is used by the verifiers when they have none of their own.
+var DefaultResolver Resolver = NewCachingResolver(NetResolver{
+	NegativeTTL: time.Minute,
+	Timeout:     10 * time.Second,
+})
+
+type mxByPref []*net.MX
+
+func (s mxByPref) Len() int           { return len(s) }
+func (s mxByPref) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s mxByPref) Less(i, j int) bool { return s[i].Pref < s[j].Pref }
+
+// MailHosts returns the hosts accepting mail for domain, best MX preference
+// first. Only when the domain has no MX records is the domain itself used,
+// if it has an address (RFC 5321 implicit MX). A null MX (".") means the
+// domain takes no mail. Failures to get a DNS answer are ErrDNSTemporary,
+// they say nothing about the address.
+func MailHosts(r Resolver, domain string) ([]string, error) {
+	if r == nil {
+		r = DefaultResolver
+	}
+
+	mx, _, err := r.LookupMX(domain)
+	if err != nil && !dnsNotFound(err) {
+		return nil, ErrDNSTemporary
+	}
+
+	if err == nil && len(mx) > 0 {
+		sorted := make(mxByPref, len(mx))
+		copy(sorted, mx)
+		sort.Stable(sorted)
+
+		hosts := make([]string, 0, len(sorted))
+		for _, m := range sorted {
+			host := strings.TrimSuffix(m.Host, ".")
+			if host == "" {
+				return nil, ErrUnresolvableHost
+			}
+			hosts = append(hosts, host)
+		}
+		return hosts, nil
+	}
+
+	addrs, _, err := r.LookupHost(domain)
+	if err != nil && !dnsNotFound(err) {
+		return nil, ErrDNSTemporary
+	}
+	if err != nil || len(addrs) == 0 {
+		return nil, ErrUnresolvableHost
+	}
+	return []string{domain}, nil
+}
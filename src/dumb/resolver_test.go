@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers from maps and counts the lookups that reach it.
+// Missing names are NXDOMAIN, names in fail get no answer at all.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	fail  map[string]bool
+	ttl   time.Duration
+	calls int
+}
+
+func (f *fakeResolver) answer(domain string, found bool) (time.Duration, error) {
+	f.calls += 1
+	if f.fail[domain] {
+		return 0, &net.DNSError{Err: "server misbehaving", Name: domain, IsTemporary: true}
+	}
+	if !found {
+		return f.ttl, &net.DNSError{Err: "no such host", Name: domain}
+	}
+	return f.ttl, nil
+}
+
+func (f *fakeResolver) LookupMX(domain string) ([]*net.MX, time.Duration, error) {
+	mx, ok := f.mx[domain]
+	ttl, err := f.answer(domain, ok)
+	return mx, ttl, err
+}
+
+func (f *fakeResolver) LookupHost(domain string) ([]string, time.Duration, error) {
+	addrs, ok := f.hosts[domain]
+	ttl, err := f.answer(domain, ok)
+	return addrs, ttl, err
+}
+
+func newTestCachingResolver(r Resolver) (*CachingResolver, *time.Time) {
+	now := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCachingResolver(r)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	fake := &fakeResolver{
+		mx:  map[string][]*net.MX{"mail.ru": {{Host: "mxs.mail.ru.", Pref: 10}}},
+		ttl: time.Minute,
+	}
+	c, now := newTestCachingResolver(fake)
+
+	c.LookupMX("mail.ru")
+	*now = now.Add(30 * time.Second)
+	mx, ttl, err := c.LookupMX("mail.ru")
+	if err != nil || len(mx) != 1 || fake.calls != 1 {
+		t.Fatalf("second lookup: %v %v, %d calls, want a cached answer", mx, err, fake.calls)
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("remaining ttl %s, want 30s", ttl)
+	}
+
+	*now = now.Add(30 * time.Second)
+	c.LookupMX("mail.ru")
+	if fake.calls != 2 {
+		t.Errorf("%d calls after expiry, want 2", fake.calls)
+	}
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	fake := &fakeResolver{ttl: time.Minute, fail: map[string]bool{"broken.ru": true}}
+	c, now := newTestCachingResolver(fake)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.LookupHost("nowhere.ru"); !dnsNotFound(err) {
+			t.Fatalf("lookup %d: %v, want not found", i, err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("%d calls for a cached NXDOMAIN, want 1", fake.calls)
+	}
+
+	*now = now.Add(time.Minute)
+	c.LookupHost("nowhere.ru")
+	if fake.calls != 2 {
+		t.Errorf("%d calls after the negative entry expired, want 2", fake.calls)
+	}
+
+	// Failures to get an answer are not cached
+	fake.calls = 0
+	c.LookupHost("broken.ru")
+	c.LookupHost("broken.ru")
+	if fake.calls != 2 {
+		t.Errorf("%d calls for a temporary failure, want 2", fake.calls)
+	}
+}
+
+// Domains looked up once are dropped once expired, without being asked for
+// again.
+func TestCachingResolverSweep(t *testing.T) {
+	fake := &fakeResolver{ttl: time.Minute}
+	c, now := newTestCachingResolver(fake)
+
+	for i := 0; i < 100; i++ {
+		domain := fmt.Sprintf("d%d.ru", i)
+		c.LookupMX(domain)
+		c.LookupHost(domain)
+	}
+	if len(c.mx) != 100 || len(c.hosts) != 100 {
+		t.Fatalf("%d mx and %d host entries, want 100 each", len(c.mx), len(c.hosts))
+	}
+
+	*now = now.Add(time.Minute)
+	c.LookupMX("mail.ru")
+	if len(c.mx) != 1 || len(c.hosts) != 0 {
+		t.Errorf("%d mx and %d host entries after expiry, want 1 and 0", len(c.mx), len(c.hosts))
+	}
+
+	// Not yet expired entries stay
+	*now = now.Add(resolverSweepInterval / 2)
+	c.LookupHost("mail.ru")
+	*now = now.Add(resolverSweepInterval / 2)
+	c.LookupHost("yandex.ru")
+	if _, ok := c.hosts["mail.ru"]; !ok || len(c.hosts) != 2 {
+		t.Errorf("host entries %v, want mail.ru and yandex.ru", c.hosts)
+	}
+}
+
+func TestMailHosts(t *testing.T) {
+	fake := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"pref.ru": {
+				{Host: "backup.pref.ru.", Pref: 20},
+				{Host: "a.pref.ru.", Pref: 10},
+				{Host: "b.pref.ru.", Pref: 10},
+			},
+			"nullmx.ru": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"implicit.ru": {"192.0.2.1"},
+			"flaky.ru":    {"192.0.2.2"},
+		},
+		fail: map[string]bool{"flaky.ru": true},
+	}
+
+	cases := []struct {
+		domain string
+		hosts  []string
+		err    error
+	}{
+		{"pref.ru", []string{"a.pref.ru", "b.pref.ru", "backup.pref.ru"}, nil},
+		{"nullmx.ru", nil, ErrUnresolvableHost},
+		{"implicit.ru", []string{"implicit.ru"}, nil},
+		{"nowhere.ru", nil, ErrUnresolvableHost},
+		// A SERVFAIL on MX must not fall back to the A record
+		{"flaky.ru", nil, ErrDNSTemporary},
+	}
+
+	for _, c := range cases {
+		hosts, err := MailHosts(fake, c.domain)
+		if err != c.err || !reflect.DeepEqual(hosts, c.hosts) {
+			t.Errorf("MailHosts(%s) = %v, %v, want %v, %v", c.domain, hosts, err, c.hosts, c.err)
+		}
+	}
+}
+
+func TestClassifyDNSErrors(t *testing.T) {
+	if s := classifyEmailCheck(ErrUnresolvableHost).Status; s != EmailStatusInvalid {
+		t.Errorf("unresolvable host: %s, want %s", s, EmailStatusInvalid)
+	}
+	if s := classifyEmailCheck(ErrDNSTemporary).Status; s != EmailStatusError {
+		t.Errorf("temporary DNS failure: %s, want %s", s, EmailStatusError)
+	}
+}
+
+// fakeDNS answers DNS queries over UDP and TCP on one local port. Names in
+// records exist, with NODATA for types they have no records of; every other
+// name is NXDOMAIN. Negative answers carry soa, unless the name ends in one
+// of bare. Names in servfail get SERVFAIL, names in silent no answer, and
+// names in truncated a truncated answer over UDP.
+type fakeDNS struct {
+	addr      string
+	records   map[string][]dnsmessage.Resource
+	soa       dnsmessage.Resource
+	bare      []string
+	servfail  map[string]bool
+	silent    map[string]bool
+	truncated map[string]bool
+}
+
+func dnsName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(name)
+}
+
+func dnsRR(name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+func (f *fakeDNS) answer(query []byte, tcp bool) ([]byte, bool) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil || len(q.Questions) != 1 {
+		return nil, false
+	}
+	question := q.Questions[0]
+	name := strings.ToLower(question.Name.String())
+
+	if f.silent[name] {
+		return nil, false
+	}
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, Authoritative: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+
+	rrs, exists := f.records[name]
+	switch {
+	case f.servfail[name]:
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+	case f.truncated[name] && !tcp:
+		resp.Header.Truncated = true
+	case !exists:
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	default:
+		for _, rr := range rrs {
+			if rr.Header.Type == question.Type {
+				resp.Answers = append(resp.Answers, rr)
+			}
+		}
+	}
+
+	if len(resp.Answers) == 0 && !resp.Header.Truncated && resp.Header.RCode != dnsmessage.RCodeServerFailure {
+		withSOA := true
+		for _, suffix := range f.bare {
+			if strings.HasSuffix(name, suffix) {
+				withSOA = false
+			}
+		}
+		if withSOA {
+			resp.Authorities = []dnsmessage.Resource{f.soa}
+		}
+	}
+
+	packet, err := resp.Pack()
+	return packet, err == nil
+}
+
+// start listens on a free port for both UDP and TCP.
+func (f *fakeDNS) start(t *testing.T) {
+	for attempt := 0; ; attempt++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if attempt < 10 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		f.addr = udp.LocalAddr().String()
+
+		go f.serveUDP(udp)
+		go f.serveTCP(tcp)
+		return
+	}
+}
+
+func (f *fakeDNS) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if packet, ok := f.answer(buf[:n], false); ok {
+			conn.WriteTo(packet, addr)
+		}
+	}
+}
+
+func (f *fakeDNS) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				packet, ok := f.answer(query, true)
+				if !ok {
+					return
+				}
+				binary.BigEndian.PutUint16(length[:], uint16(len(packet)))
+				conn.Write(append(length[:], packet...))
+			}
+		}(conn)
+	}
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	mx := func(name string, host string, pref uint16, ttl uint32) dnsmessage.Resource {
+		rr := dnsRR(name, ttl, &dnsmessage.MXResource{Pref: pref, MX: dnsName(host)})
+		rr.Header.Type = dnsmessage.TypeMX
+		return rr
+	}
+	a := func(name string, ip string, ttl uint32) dnsmessage.Resource {
+		var body dnsmessage.AResource
+		copy(body.A[:], net.ParseIP(ip).To4())
+		rr := dnsRR(name, ttl, &body)
+		rr.Header.Type = dnsmessage.TypeA
+		return rr
+	}
+	aaaa := func(name string, ip string, ttl uint32) dnsmessage.Resource {
+		var body dnsmessage.AAAAResource
+		copy(body.AAAA[:], net.ParseIP(ip))
+		rr := dnsRR(name, ttl, &body)
+		rr.Header.Type = dnsmessage.TypeAAAA
+		return rr
+	}
+
+	soa := dnsRR("test.", 3600, &dnsmessage.SOAResource{
+		NS: dnsName("ns.test."), MBox: dnsName("admin.test."),
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 45,
+	})
+	soa.Header.Type = dnsmessage.TypeSOA
+
+	f := &fakeDNS{
+		records: map[string][]dnsmessage.Resource{
+			"mail.test.": {
+				mx("mail.test.", "mx1.mail.test.", 10, 300),
+				mx("mail.test.", "mx2.mail.test.", 20, 120),
+				a("mail.test.", "192.0.2.1", 60),
+				aaaa("mail.test.", "2001:db8::1", 30),
+			},
+			"nomx.test.":   {a("nomx.test.", "192.0.2.2", 600)},
+			"v4only.test.": {a("v4only.test.", "192.0.2.3", 90)},
+			"big.test.":    {mx("big.test.", "mx.big.test.", 5, 200)},
+		},
+		soa:       soa,
+		bare:      []string{".bare.test."},
+		servfail:  map[string]bool{"broken.test.": true},
+		silent:    map[string]bool{"slow.test.": true},
+		truncated: map[string]bool{"big.test.": true},
+	}
+	f.start(t)
+	return f
+}
+
+// dnsErrKind names the class of a lookup error as dnsNotFound sees it.
+func dnsErrKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	if dnsNotFound(err) {
+		return "not found"
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Timeout() {
+		return "timeout"
+	}
+	return "temporary"
+}
+
+func TestNetResolver(t *testing.T) {
+	dns := newFakeDNS(t)
+	r := NetResolver{Server: dns.addr, NegativeTTL: 7 * time.Second, Timeout: 200 * time.Millisecond}
+
+	cases := []struct {
+		lookup string
+		domain string
+		answer []string
+		ttl    time.Duration
+		err    string
+	}{
+		// The smallest record TTL
+		{"mx", "mail.test", []string{"mx1.mail.test. 10", "mx2.mail.test. 20"}, 120 * time.Second, ""},
+		{"mx", "MAIL.test.", []string{"mx1.mail.test. 10", "mx2.mail.test. 20"}, 120 * time.Second, ""},
+		// Over TCP after a truncated UDP answer
+		{"mx", "big.test", []string{"mx.big.test. 5"}, 200 * time.Second, ""},
+		// NODATA and NXDOMAIN live for the SOA minimum, or NegativeTTL
+		{"mx", "nomx.test", nil, 45 * time.Second, "not found"},
+		{"mx", "nowhere.test", nil, 45 * time.Second, "not found"},
+		{"mx", "nowhere.bare.test", nil, 7 * time.Second, "not found"},
+		// No answer is not cached
+		{"mx", "broken.test", nil, 0, "temporary"},
+		{"mx", "slow.test", nil, 0, "timeout"},
+
+		{"host", "mail.test", []string{"192.0.2.1", "2001:db8::1"}, 30 * time.Second, ""},
+		{"host", "v4only.test", []string{"192.0.2.3"}, 90 * time.Second, ""},
+		{"host", "nowhere.test", nil, 45 * time.Second, "not found"},
+		{"host", "broken.test", nil, 0, "temporary"},
+	}
+
+	for _, c := range cases {
+		var answer []string
+		var ttl time.Duration
+		var err error
+
+		if c.lookup == "mx" {
+			var mx []*net.MX
+			mx, ttl, err = r.LookupMX(c.domain)
+			for _, m := range mx {
+				answer = append(answer, fmt.Sprintf("%s %d", m.Host, m.Pref))
+			}
+		} else {
+			answer, ttl, err = r.LookupHost(c.domain)
+		}
+
+		if !reflect.DeepEqual(answer, c.answer) || ttl != c.ttl || dnsErrKind(err) != c.err {
+			t.Errorf("%s %s = %v, %s, %v, want %v, %s, %q", c.lookup, c.domain, answer, ttl, err, c.answer, c.ttl, c.err)
+		}
+	}
+
+	// And through MailHosts, with the A fallback
+	hosts, err := MailHosts(r, "nomx.test")
+	if err != nil || !reflect.DeepEqual(hosts, []string{"nomx.test"}) {
+		t.Errorf("MailHosts(nomx.test) = %v, %v", hosts, err)
+	}
+}
+
+// dnsNotFound has to sort the errors of the net package's own resolver the
+// same way.
+func TestDNSNotFoundNetErrors(t *testing.T) {
+	dns := newFakeDNS(t)
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dns.addr)
+		},
+	}
+
+	cases := []struct {
+		domain string
+		err    string
+	}{
+		{"nowhere.test.", "not found"},
+		{"nomx.test.", "not found"},
+		{"broken.test.", "temporary"},
+		{"slow.test.", "timeout"},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		_, err := r.LookupMX(ctx, c.domain)
+		cancel()
+		if dnsErrKind(err) != c.err {
+			t.Errorf("LookupMX(%s): %#v, want %s", c.domain, err, c.err)
+		}
+	}
+}
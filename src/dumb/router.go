@@ -0,0 +1,209 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "github.com/valyala/fasthttp"
+)
+
+// Routes are registered as method + pattern, e.g. GET /users/:id/visits.
+// ":name" matches one non-empty path segment, ":id" only one made of digits,
+// "*name" the rest of the path, slashes included. Routes are tried in
+// registration order, so literal segments (/locations/top) go before params
+// (/countries/:name/avg). A trailing slash is ignored. A path known under
+// other methods only answers 405 with Allow, GET /users/new included.
+//
+// Matching works on ctx.Path() in place, params are sub-slices of it, so the
+// hot path does not allocate.
+
+const maxRouteParams = 4
+
+type RouteParams struct {
+  n          int
+  vals       [maxRouteParams][]byte
+}
+
+// Int parses param i as a decimal int, like strconv.Atoi but without
+// converting the bytes to a string first.
+func (p RouteParams) Int(i int) (int, bool) {
+  b := p.vals[i]
+  neg := false
+  if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+    neg = b[0] == '-'
+    b = b[1:]
+  }
+  if len(b) == 0 || len(b) > 18 {
+    return 0, false
+  }
+
+  n := 0
+  for _, c := range b {
+    if c < '0' || c > '9' {
+      return 0, false
+    }
+    n = n * 10 + int(c - '0')
+  }
+  if neg {
+    n = -n
+  }
+  return n, true
+}
+
+func (p RouteParams) String(i int) string {
+  return string(p.vals[i])
+}
+
+type RouteHandler func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte)
+
+type routeSegment struct {
+  literal    string
+  param      bool
+  digits     bool
+  rest       bool
+}
+
+type route struct {
+  method     string
+  pattern    string
+  segments   []routeSegment
+  handler    RouteHandler
+}
+
+type Router struct {
+  routes     []route
+}
+
+func (r *Router) Handle(method string, pattern string, handler RouteHandler) {
+  rt := route{method: method, pattern: pattern, handler: handler}
+
+  params := 0
+  for _, s := range strings.Split(strings.Trim(pattern, "/"), "/") {
+    var seg routeSegment
+    if strings.HasPrefix(s, ":") {
+      seg.param = true
+      seg.digits = s == ":id"
+    } else if strings.HasPrefix(s, "*") {
+      seg.rest = true
+    } else {
+      seg.literal = s
+    }
+    if seg.param || seg.rest {
+      params += 1
+    }
+    rt.segments = append(rt.segments, seg)
+  }
+
+  if params > maxRouteParams {
+    panic("too many params in route " + pattern)
+  }
+  r.routes = append(r.routes, rt)
+}
+
+func (r *Router) GET(pattern string, handler RouteHandler) {
+  r.Handle("GET", pattern, handler)
+}
+
+func (r *Router) POST(pattern string, handler RouteHandler) {
+  r.Handle("POST", pattern, handler)
+}
+
+func (rt *route) match(path []byte, p *RouteParams) bool {
+  p.n = 0
+  for i := range rt.segments {
+    seg := &rt.segments[i]
+    if len(path) == 0 || path[0] != '/' {
+      return false
+    }
+    path = path[1:]
+
+    if seg.rest {
+      if len(path) == 0 {
+        return false
+      }
+      p.vals[p.n] = path
+      p.n += 1
+      return true
+    }
+
+    end := bytes.IndexByte(path, '/')
+    if end < 0 {
+      end = len(path)
+    }
+    part := path[:end]
+    path = path[end:]
+
+    if seg.param {
+      if len(part) == 0 || (seg.digits && !allDigits(part)) {
+        return false
+      }
+      p.vals[p.n] = part
+      p.n += 1
+    } else if string(part) != seg.literal {
+      return false
+    }
+  }
+
+  return len(path) == 0
+}
+
+func allDigits(b []byte) bool {
+  for _, c := range b {
+    if c < '0' || c > '9' {
+      return false
+    }
+  }
+  return true
+}
+
+// Dispatch runs the handler of the first route matching the request.
+func (r *Router) Dispatch(ctx *fasthttp.RequestCtx) (int, []byte) {
+  path := ctx.Path()
+  if len(path) > 1 && path[len(path) - 1] == '/' {
+    path = path[:len(path) - 1]
+  }
+  method := ctx.Method()
+
+  var p RouteParams
+  pathKnown := false
+  for i := range r.routes {
+    rt := &r.routes[i]
+    if !rt.match(path, &p) {
+      continue
+    }
+    if string(method) == rt.method {
+      return rt.handler(ctx, p)
+    }
+    pathKnown = true
+  }
+
+  if !pathKnown {
+    return notFoundResponse()
+  }
+
+  ctx.Response.Header.Set("Allow", strings.Join(r.allowed(path), ", "))
+  return errorResponse(405, errMethodNotAllowed)
+}
+
+func (r *Router) allowed(path []byte) []string {
+  var p RouteParams
+  var methods []string
+
+  for i := range r.routes {
+    rt := &r.routes[i]
+    if !rt.match(path, &p) {
+      continue
+    }
+    seen := false
+    for _, m := range methods {
+      if m == rt.method {
+        seen = true
+        break
+      }
+    }
+    if !seen {
+      methods = append(methods, rt.method)
+    }
+  }
+
+  return methods
+}
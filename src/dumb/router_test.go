@@ -0,0 +1,136 @@
+package main
+
+import (
+  "testing"
+  "github.com/valyala/fasthttp"
+)
+
+func newTestRouter() *Router {
+  r := &Router{}
+  named := func(name string) RouteHandler {
+    return func(ctx *fasthttp.RequestCtx, p RouteParams) (int, []byte) {
+      out := name
+      for i := 0; i < p.n; i++ {
+        out += " " + p.String(i)
+      }
+      return 200, []byte(out)
+    }
+  }
+
+  r.POST("/users/new", named("new user"))
+  r.GET("/users/by-email/*email", named("by email"))
+  r.GET("/users/:id", named("get user"))
+  r.POST("/users/:id", named("post user"))
+  r.GET("/users/:id/visits", named("user visits"))
+  r.GET("/locations/top", named("top"))
+  r.POST("/locations/:id", named("post location"))
+  r.GET("/countries/:name/avg", named("country avg"))
+
+  return r
+}
+
+func TestRouterDispatch(t *testing.T) {
+  r := newTestRouter()
+
+  cases := []struct {
+    method string
+    uri    string
+    status int
+    body   string
+    allow  string
+  }{
+    {"GET", "/users/1", 200, "get user 1", ""},
+    {"POST", "/users/1", 200, "post user 1", ""},
+    {"GET", "/users/1/", 200, "get user 1", ""},
+    {"GET", "/users/1?visits=1", 200, "get user 1", ""},
+    {"GET", "/users/12/visits", 200, "user visits 12", ""},
+    {"GET", "/users/by-email/a/b@mail.ru", 200, "by email a/b@mail.ru", ""},
+    {"GET", "/countries/Россия/avg", 200, "country avg Россия", ""},
+    {"POST", "/users/new", 200, "new user", ""},
+
+    // Known paths, wrong method
+    {"GET", "/users/new", 405, "", "POST"},
+    {"DELETE", "/users/1", 405, "", "GET, POST"},
+    {"POST", "/users/1/visits", 405, "", "GET"},
+    {"POST", "/locations/top", 405, "", "GET"},
+    {"GET", "/locations/1", 405, "", "POST"},
+
+    // :id is digits only
+    {"GET", "/users/abc", 404, "", ""},
+    {"GET", "/users/-1", 404, "", ""},
+    {"GET", "/users/1/anything", 404, "", ""},
+    {"GET", "/users", 404, "", ""},
+    {"GET", "/users//visits", 404, "", ""},
+    {"GET", "/", 404, "", ""},
+  }
+
+  defer func(compat bool) { compatEmptyErrors = compat }(compatEmptyErrors)
+  compatEmptyErrors = true
+
+  for _, c := range cases {
+    var ctx fasthttp.RequestCtx
+    ctx.Request.Header.SetMethod(c.method)
+    ctx.Request.SetRequestURI(c.uri)
+
+    status, body := r.Dispatch(&ctx)
+    allow := string(ctx.Response.Header.Peek("Allow"))
+    if status != c.status || string(body) != c.body || allow != c.allow {
+      t.Errorf("%s %s = %d %q, Allow %q, want %d %q, Allow %q",
+        c.method, c.uri, status, body, allow, c.status, c.body, c.allow)
+    }
+  }
+}
+
+func TestRouteParamsInt(t *testing.T) {
+  cases := []struct {
+    in     string
+    n      int
+    ok     bool
+  }{
+    {"0", 0, true},
+    {"123", 123, true},
+    {"-5", -5, true},
+    {"", 0, false},
+    {"12a", 0, false},
+    {"1234567890123456789", 0, false},
+  }
+
+  for _, c := range cases {
+    var p RouteParams
+    p.vals[0] = []byte(c.in)
+    if n, ok := p.Int(0); n != c.n || ok != c.ok {
+      t.Errorf("Int(%q) = %d, %v, want %d, %v", c.in, n, ok, c.n, c.ok)
+    }
+  }
+}
+
+// matchAPIRoute does what Dispatch does up to calling the handler
+func matchAPIRoute(method []byte, path []byte) int {
+  var p RouteParams
+  for i := range apiRouter.routes {
+    rt := &apiRouter.routes[i]
+    if rt.match(path, &p) && string(method) == rt.method {
+      id, _ := p.Int(0)
+      return id
+    }
+  }
+  return -1
+}
+
+func TestRouterMatchAllocs(t *testing.T) {
+  method, path := []byte("GET"), []byte("/locations/123/demographics")
+  allocs := testing.AllocsPerRun(1000, func() {
+    matchAPIRoute(method, path)
+  })
+  if allocs != 0 {
+    t.Errorf("matching %s allocates %v times, want 0", path, allocs)
+  }
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+  method, path := []byte("GET"), []byte("/locations/123/demographics")
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    matchAPIRoute(method, path)
+  }
+}
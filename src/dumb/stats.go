@@ -0,0 +1,303 @@
+package main
+
+import (
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/valyala/fasthttp"
+)
+
+type MarkStats struct {
+  Count      int      `json:"count"`
+  Sum        int      `json:"sum"`
+  Min        int      `json:"min"`
+  Max        int      `json:"max"`
+  Avg        float64  `json:"avg"`
+  Median     float64  `json:"median"`
+  StdDev     float64  `json:"stddev"`
+  Histogram  [6]int   `json:"histogram"`
+}
+
+// round5 rounds x to 5 decimal places, halves away from zero. All float
+// fields of MarkStats go through it, so 2.5 stays 2.5 and 1/3 is 0.33333.
+func round5(x float64) float64 {
+  if x < 0 {
+    return -round5(-x)
+  }
+  return math.Floor(x * 100000 + 0.5) / 100000
+}
+
+// NewMarkStats computes the summary for a list of marks. Marks are sorted
+// in place. With no marks every field is zero.
+func NewMarkStats(marks []int) MarkStats {
+  var s MarkStats
+
+  s.Count = len(marks)
+  if s.Count == 0 {
+    return s
+  }
+
+  sort.Ints(marks)
+  s.Min = marks[0]
+  s.Max = marks[s.Count - 1]
+
+  for _, m := range marks {
+    s.Sum += m
+    if m >= 0 && m < len(s.Histogram) {
+      s.Histogram[m] += 1
+    }
+  }
+
+  mean := float64(s.Sum) / float64(s.Count)
+
+  if s.Count % 2 == 1 {
+    s.Median = float64(marks[s.Count / 2])
+  } else {
+    s.Median = float64(marks[s.Count / 2 - 1] + marks[s.Count / 2]) / 2
+  }
+
+  // Population standard deviation, the visits are the whole set not a sample
+  variance := 0.0
+  for _, m := range marks {
+    d := float64(m) - mean
+    variance += d * d
+  }
+  variance /= float64(s.Count)
+
+  s.Avg = round5(mean)
+  s.Median = round5(s.Median)
+  s.StdDev = round5(math.Sqrt(variance))
+
+  return s
+}
+
+func LocationsHandlerGETStats(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  visitIDs := hlVisitsByLoc[lid]
+  marks := make([]int, 0, len(visitIDs))
+
+  filter, apiErr := ParseLocationVisitsFilter(ctx.QueryArgs())
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  for _, vID := range visitIDs {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if filter.Match(v, &u) {
+      marks = append(marks, *v.Mark)
+    }
+  }
+
+  return 200, []byte(toJson(NewMarkStats(marks)))
+}
+
+// Age buckets are given by their lower edges, ageBuckets=18,25,35 makes
+// groups "0-18", "18-25", "25-35" and "35+".
+type AgeBuckets []int
+
+var defaultAgeBuckets = AgeBuckets{18, 25, 35, 45, 55, 65}
+
+func ParseAgeBuckets(params *fasthttp.Args, name string) (AgeBuckets, *APIError) {
+  if !params.Has(name) {
+    return defaultAgeBuckets, nil
+  }
+
+  var b AgeBuckets
+  for _, e := range strings.Split(string(params.Peek(name)), ",") {
+    edge, err := strconv.Atoi(e)
+    if err != nil || edge <= 0 || (len(b) > 0 && edge <= b[len(b) - 1]) {
+      return nil, badParam(name)
+    }
+    b = append(b, edge)
+  }
+
+  return b, nil
+}
+
+// Edges as birth_date bounds at one time: those born after the i-th cutoff
+// are younger than the i-th edge.
+type AgeCutoffs []int64
+
+// Cutoffs works the edges out with LatestBirthAt once per request, as
+// ParseLocationVisitsFilter does for fromAge/toAge, so visits are bucketed
+// without computing ages and agree with the age filters at any time of day.
+func (b AgeBuckets) Cutoffs(now time.Time) AgeCutoffs {
+  c := make(AgeCutoffs, len(b))
+  for i, edge := range b {
+    c[i] = LatestBirthAt(edge, now)
+  }
+  return c
+}
+
+// Index returns the bucket number, 0 to len(c), of someone born at birthDate
+func (c AgeCutoffs) Index(birthDate int64) int {
+  for i, cutoff := range c {
+    if birthDate > cutoff {
+      return i
+    }
+  }
+  return len(c)
+}
+
+func (b AgeBuckets) Name(i int) string {
+  lower := 0
+  if i > 0 {
+    lower = b[i - 1]
+  }
+  if i == len(b) {
+    return strconv.Itoa(lower) + "+"
+  }
+  return strconv.Itoa(lower) + "-" + strconv.Itoa(b[i])
+}
+
+type MarkGroup struct {
+  Avg        float64  `json:"avg"`
+  Count      int      `json:"count"`
+}
+
+type MarkGroupsOut struct {
+  Groups     map[string]MarkGroup `json:"groups"`
+}
+
+// ParseGroupBy returns the function mapping a visit to its group key for
+// groupBy=gender|age_bucket|year|month. Years and months are taken in UTC,
+// age buckets at now.
+func ParseGroupBy(params *fasthttp.Args, now time.Time) (func(v *Visit, u *User) string, *APIError) {
+  switch string(params.Peek("groupBy")) {
+  case "gender":
+    return func(v *Visit, u *User) string {
+      return u.Gender
+    }, nil
+  case "age_bucket":
+    buckets, apiErr := ParseAgeBuckets(params, "ageBuckets")
+    if apiErr != nil {
+      return nil, apiErr
+    }
+    cutoffs := buckets.Cutoffs(now)
+    return func(v *Visit, u *User) string {
+      return buckets.Name(cutoffs.Index(u.BirthDate))
+    }, nil
+  case "year":
+    return func(v *Visit, u *User) string {
+      return time.Unix(v.VisitedAt, 0).UTC().Format("2006")
+    }, nil
+  case "month":
+    return func(v *Visit, u *User) string {
+      return time.Unix(v.VisitedAt, 0).UTC().Format("2006-01")
+    }, nil
+  }
+  return nil, badParam("groupBy")
+}
+
+func LocationsHandlerGETAvgGrouped(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  visitIDs := hlVisitsByLoc[lid]
+
+  params := ctx.QueryArgs()
+
+  filter, apiErr := ParseLocationVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  groupKey, apiErr := ParseGroupBy(params, filter.Now)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  sums := make(map[string]int)
+  counts := make(map[string]int)
+
+  for _, vID := range visitIDs {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if filter.Match(v, &u) {
+      key := groupKey(v, &u)
+      sums[key] += *v.Mark
+      counts[key] += 1
+    }
+  }
+
+  out := MarkGroupsOut{make(map[string]MarkGroup, len(counts))}
+  for key, cnt := range counts {
+    out.Groups[key] = MarkGroup{round5(float64(sums[key]) / float64(cnt)), cnt}
+  }
+
+  return 200, []byte(toJson(out))
+}
+
+type DemographicOut struct {
+  AgeBucket  string   `json:"age_bucket"`
+  Gender     string   `json:"gender"`
+  Visitors   int      `json:"visitors"`
+  Count      int      `json:"count"`
+  Avg        float64  `json:"avg"`
+}
+
+type DemographicsOut struct {
+  Demographics []DemographicOut `json:"demographics"`
+}
+
+// LocationsHandlerGETDemographics splits a location's visits by visitor age
+// bucket (ageBuckets=, see AgeBuckets) and gender. Visitors counts distinct
+// users, Count and Avg their visits. Groups without visits are left out.
+func LocationsHandlerGETDemographics(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  params := ctx.QueryArgs()
+
+  filter, apiErr := ParseLocationVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  buckets, apiErr := ParseAgeBuckets(params, "ageBuckets")
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  cutoffs := buckets.Cutoffs(filter.Now)
+  genders := []string{"f", "m"}
+  groups := make([]DemographicOut, (len(buckets) + 1) * len(genders))
+  sums := make([]int, len(groups))
+  seen := make(map[int]bool)
+
+  for i := range groups {
+    groups[i].AgeBucket = buckets.Name(i / len(genders))
+    groups[i].Gender = genders[i % len(genders)]
+  }
+
+  for _, vID := range hlVisitsByLoc[lid] {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if !filter.Match(v, &u) {
+      continue
+    }
+
+    i := cutoffs.Index(u.BirthDate) * len(genders)
+    if u.Gender == "m" {
+      i += 1
+    } else if u.Gender != "f" {
+      continue
+    }
+
+    groups[i].Count += 1
+    sums[i] += *v.Mark
+    if !seen[u.ID] {
+      seen[u.ID] = true
+      groups[i].Visitors += 1
+    }
+  }
+
+  out := DemographicsOut{make([]DemographicOut, 0)}
+  for i, g := range groups {
+    if g.Count > 0 {
+      g.Avg = round5(float64(sums[i]) / float64(g.Count))
+      out.Demographics = append(out.Demographics, g)
+    }
+  }
+
+  return 200, []byte(toJson(out))
+}
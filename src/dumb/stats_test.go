@@ -0,0 +1,111 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestRound5(t *testing.T) {
+  cases := []struct {
+    in    float64
+    out   float64
+  }{
+    {0, 0},
+    {2.5, 2.5},
+    {1.0 / 3, 0.33333},
+    {2.0 / 3, 0.66667},
+    // Exactly half-way at the 6th digit, both are exact binary fractions
+    {1.0 / 64, 0.01563},
+    {3.0 / 64, 0.04688},
+    {-3.0 / 64, -0.04688},
+    {0.0000049, 0},
+    {4.999996, 5},
+  }
+
+  for _, c := range cases {
+    if got := round5(c.in); got != c.out {
+      t.Errorf("round5(%v) = %v, want %v", c.in, got, c.out)
+    }
+  }
+}
+
+func TestNewMarkStats(t *testing.T) {
+  halfway := make([]int, 64)
+  halfway[0], halfway[1], halfway[2] = 1, 1, 1
+
+  cases := []struct {
+    name   string
+    marks  []int
+    stats  MarkStats
+  }{
+    {"empty", nil, MarkStats{}},
+    {"one", []int{4}, MarkStats{Count: 1, Sum: 4, Min: 4, Max: 4, Avg: 4, Median: 4, Histogram: [6]int{0, 0, 0, 0, 1, 0}}},
+    {"odd", []int{5, 1, 3}, MarkStats{Count: 3, Sum: 9, Min: 1, Max: 5, Avg: 3, Median: 3, StdDev: 1.63299, Histogram: [6]int{0, 1, 0, 1, 0, 1}}},
+    {"even", []int{4, 1, 3, 2}, MarkStats{Count: 4, Sum: 10, Min: 1, Max: 4, Avg: 2.5, Median: 2.5, StdDev: 1.11803, Histogram: [6]int{0, 1, 1, 1, 1, 0}}},
+    {"even, median between zeros", []int{0, 5, 0, 5, 0, 0}, MarkStats{Count: 6, Sum: 10, Min: 0, Max: 5, Avg: 1.66667, Median: 0, StdDev: 2.35702, Histogram: [6]int{4, 0, 0, 0, 0, 2}}},
+    {"half-way average", halfway, MarkStats{Count: 64, Sum: 3, Min: 0, Max: 1, Avg: 0.04688, Median: 0, StdDev: 0.21137, Histogram: [6]int{61, 3, 0, 0, 0, 0}}},
+  }
+
+  for _, c := range cases {
+    if got := NewMarkStats(c.marks); got != c.stats {
+      t.Errorf("%s: NewMarkStats(%v) = %+v, want %+v", c.name, c.marks, got, c.stats)
+    }
+  }
+}
+
+// /avg and /stats have to give the same average for the same visits
+func TestAvgResponseMatchesStats(t *testing.T) {
+  cases := []struct {
+    total  int
+    cnt    int
+    body   string
+  }{
+    {0, 0, `{"avg": 0.00000}`},
+    {5, 2, `{"avg": 2.50000}`},
+    {1, 3, `{"avg": 0.33333}`},
+    {3, 64, `{"avg": 0.04688}`},
+    {46, 19, `{"avg": 2.42105}`},
+  }
+
+  for _, c := range cases {
+    if got := string(avgResponse(c.total, c.cnt)); got != c.body {
+      t.Errorf("avgResponse(%d, %d) = %s, want %s", c.total, c.cnt, got, c.body)
+    }
+  }
+}
+
+// Bucketing by birth date cutoffs gives the bucket of the visitor's age.
+func TestAgeCutoffsIndex(t *testing.T) {
+  buckets := AgeBuckets{18, 25, 35}
+
+  for _, now := range []time.Time{
+    time.Date(2017, 2, 28, 12, 0, 0, 0, time.UTC),
+    time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+    time.Date(2017, 12, 31, 23, 59, 59, 0, time.UTC),
+  } {
+    cutoffs := buckets.Cutoffs(now)
+
+    for _, edge := range buckets {
+      // Every day around the edge's birthdays
+      around := time.Date(now.Year() - edge, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+      for day := -3; day <= 3; day++ {
+        for _, second := range []int{0, 86399} {
+          birth := around.AddDate(0, 0, day).Add(time.Duration(second) * time.Second)
+
+          age := AgeAtIn(birth, now, time.UTC)
+          want := len(buckets)
+          for i, e := range buckets {
+            if age < e {
+              want = i
+              break
+            }
+          }
+
+          if got := cutoffs.Index(birth.Unix()); got != want {
+            t.Errorf("now %s, born %s, age %d: bucket %d, want %d", now, birth, age, got, want)
+          }
+        }
+      }
+    }
+  }
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "time"
+  "github.com/valyala/fasthttp"
+)
+
+// Visits bucketed by day, week (starting Monday), month or year of VisitedAt
+// in the timezone given by tz= (an IANA name, UTC by default).
+
+type TimelineBucketOut struct {
+  Bucket     string   `json:"bucket"`
+  From       int64    `json:"from"`
+  Count      int      `json:"count"`
+  Avg        float64  `json:"avg"`
+}
+
+type TimelineType []TimelineBucketOut
+
+type TimelineOut struct {
+  Timeline   []TimelineBucketOut `json:"timeline"`
+}
+
+func (s TimelineType) Len() int {
+  return len(s)
+}
+
+func (s TimelineType) Swap(i, j int) {
+  s[i], s[j] = s[j], s[i]
+}
+
+func (s TimelineType) Less(i, j int) bool {
+  return s[i].From < s[j].From
+}
+
+type Timeline struct {
+  Bucket     string
+  Location   *time.Location
+  sums       map[int64]int
+  counts     map[int64]int
+}
+
+// Zones loaded for tz=, time.LoadLocation reads zoneinfo from disk. Only
+// valid names are kept, so the map can't grow past the zone database.
+var timelineLocations = make(map[string]*time.Location)
+var timelineLocationsMutex sync.Mutex
+
+func loadTimelineLocation(name string) (*time.Location, error) {
+  timelineLocationsMutex.Lock()
+  loc, ok := timelineLocations[name]
+  timelineLocationsMutex.Unlock()
+  if ok {
+    return loc, nil
+  }
+
+  loc, err := time.LoadLocation(name)
+  if err != nil {
+    return nil, err
+  }
+
+  timelineLocationsMutex.Lock()
+  timelineLocations[name] = loc
+  timelineLocationsMutex.Unlock()
+  return loc, nil
+}
+
+func ParseTimeline(params *fasthttp.Args) (*Timeline, *APIError) {
+  t := &Timeline{Bucket: "day", Location: time.UTC, sums: make(map[int64]int), counts: make(map[int64]int)}
+
+  if params.Has("bucket") {
+    t.Bucket = string(params.Peek("bucket"))
+    if t.Bucket != "day" && t.Bucket != "week" && t.Bucket != "month" && t.Bucket != "year" {
+      return nil, badParam("bucket")
+    }
+  }
+
+  if params.Has("tz") {
+    loc, err := loadTimelineLocation(string(params.Peek("tz")))
+    if err != nil {
+      return nil, badParam("tz")
+    }
+    t.Location = loc
+  }
+
+  return t, nil
+}
+
+// start returns the beginning of the bucket holding ts
+func (t *Timeline) start(ts int64) time.Time {
+  d := time.Unix(ts, 0).In(t.Location)
+  year, month, day := d.Date()
+
+  switch t.Bucket {
+  case "week":
+    return time.Date(year, month, day - (int(d.Weekday()) + 6) % 7, 0, 0, 0, 0, t.Location)
+  case "month":
+    return time.Date(year, month, 1, 0, 0, 0, 0, t.Location)
+  case "year":
+    return time.Date(year, 1, 1, 0, 0, 0, 0, t.Location)
+  }
+  return time.Date(year, month, day, 0, 0, 0, 0, t.Location)
+}
+
+func (t *Timeline) Add(v *Visit) {
+  from := t.start(v.VisitedAt).Unix()
+  t.sums[from] += *v.Mark
+  t.counts[from] += 1
+}
+
+func (t *Timeline) Out() TimelineOut {
+  layout := "2006-01-02"
+  if t.Bucket == "month" {
+    layout = "2006-01"
+  } else if t.Bucket == "year" {
+    layout = "2006"
+  }
+
+  buckets := make([]TimelineBucketOut, 0, len(t.counts))
+  for from, cnt := range t.counts {
+    label := time.Unix(from, 0).In(t.Location).Format(layout)
+    buckets = append(buckets, TimelineBucketOut{label, from, cnt, round5(float64(t.sums[from]) / float64(cnt))})
+  }
+
+  sort.Sort(TimelineType(buckets))
+  return TimelineOut{buckets}
+}
+
+func LocationsHandlerGETTimeline(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  params := ctx.QueryArgs()
+
+  filter, apiErr := ParseLocationVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  timeline, apiErr := ParseTimeline(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  for _, vID := range hlVisitsByLoc[lid] {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if filter.Match(v, &u) {
+      timeline.Add(v)
+    }
+  }
+
+  return 200, []byte(toJson(timeline.Out()))
+}
+
+func UsersHandlerGETTimeline(ctx *fasthttp.RequestCtx, uid int) (int, []byte) {
+  params := ctx.QueryArgs()
+
+  filter, apiErr := ParseUserVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  timeline, apiErr := ParseTimeline(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  for _, vID := range hlVisitsByUser[uid] {
+    v := hlVisitsData[vID]
+    l := hlLocationsData[v.Location]
+
+    if filter.Match(v, &l) {
+      timeline.Add(v)
+    }
+  }
+
+  return 200, []byte(toJson(timeline.Out()))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+  "time"
+  "github.com/valyala/fasthttp"
+)
+
+func TestParseTimeline(t *testing.T) {
+  if _, err := time.LoadLocation("Asia/Vladivostok"); err != nil {
+    t.Skip("no zoneinfo:", err)
+  }
+
+  cases := []struct {
+    query  string
+    bucket string
+    tz     string
+    err    *APIError
+  }{
+    {"", "day", "UTC", nil},
+    {"bucket=week", "week", "UTC", nil},
+    {"bucket=year&tz=Asia/Vladivostok", "year", "Asia/Vladivostok", nil},
+    {"bucket=hour", "", "", badParam("bucket")},
+    {"tz=Mars/Olympus", "", "", badParam("tz")},
+    {"tz=", "day", "UTC", nil},
+  }
+
+  for _, c := range cases {
+    var args fasthttp.Args
+    args.Parse(c.query)
+
+    tl, err := ParseTimeline(&args)
+    if !reflect.DeepEqual(err, c.err) {
+      t.Errorf("%q: error %v, want %v", c.query, err, c.err)
+      continue
+    }
+    if err == nil && (tl.Bucket != c.bucket || tl.Location.String() != c.tz) {
+      t.Errorf("%q: bucket %s in %s, want %s in %s", c.query, tl.Bucket, tl.Location, c.bucket, c.tz)
+    }
+  }
+}
+
+func TestTimelineStart(t *testing.T) {
+  vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+  if err != nil {
+    t.Skip("no zoneinfo:", err)
+  }
+
+  utc := func(y, m, d, hour, min int) time.Time {
+    return time.Date(y, time.Month(m), d, hour, min, 0, 0, time.UTC)
+  }
+  vlat := func(y, m, d, hour, min int) time.Time {
+    return time.Date(y, time.Month(m), d, hour, min, 0, 0, vladivostok)
+  }
+
+  cases := []struct {
+    bucket string
+    loc    *time.Location
+    at     time.Time
+    start  time.Time
+  }{
+    // 2017-12-31 15:00 UTC is already 2018 in Vladivostok, a Monday
+    {"day", time.UTC, utc(2017, 12, 31, 15, 0), utc(2017, 12, 31, 0, 0)},
+    {"week", time.UTC, utc(2017, 12, 31, 15, 0), utc(2017, 12, 25, 0, 0)},
+    {"month", time.UTC, utc(2017, 12, 31, 15, 0), utc(2017, 12, 1, 0, 0)},
+    {"year", time.UTC, utc(2017, 12, 31, 15, 0), utc(2017, 1, 1, 0, 0)},
+    {"day", vladivostok, utc(2017, 12, 31, 15, 0), vlat(2018, 1, 1, 0, 0)},
+    {"week", vladivostok, utc(2017, 12, 31, 15, 0), vlat(2018, 1, 1, 0, 0)},
+    {"month", vladivostok, utc(2017, 12, 31, 15, 0), vlat(2018, 1, 1, 0, 0)},
+    {"year", vladivostok, utc(2017, 12, 31, 15, 0), vlat(2018, 1, 1, 0, 0)},
+
+    // Weeks run Monday to Sunday
+    {"week", vladivostok, vlat(2017, 10, 16, 0, 0), vlat(2017, 10, 16, 0, 0)},
+    {"week", vladivostok, vlat(2017, 10, 22, 23, 59), vlat(2017, 10, 16, 0, 0)},
+    {"week", vladivostok, vlat(2017, 10, 23, 0, 0), vlat(2017, 10, 23, 0, 0)},
+    // A week across a month and a year
+    {"week", vladivostok, vlat(2019, 1, 2, 12, 0), vlat(2018, 12, 31, 0, 0)},
+
+    // Month edges in the zone, not in UTC
+    {"month", vladivostok, utc(2017, 10, 31, 14, 30), vlat(2017, 11, 1, 0, 0)},
+    {"month", vladivostok, utc(2017, 10, 31, 13, 30), vlat(2017, 10, 1, 0, 0)},
+    {"month", vladivostok, vlat(2020, 2, 29, 23, 59), vlat(2020, 2, 1, 0, 0)},
+  }
+
+  for _, c := range cases {
+    tl := &Timeline{Bucket: c.bucket, Location: c.loc}
+    if got := tl.start(c.at.Unix()); !got.Equal(c.start) {
+      t.Errorf("%s in %s at %s: %s, want %s", c.bucket, c.loc, c.at, got, c.start)
+    }
+  }
+}
+
+func TestTimelineOut(t *testing.T) {
+  vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+  if err != nil {
+    t.Skip("no zoneinfo:", err)
+  }
+
+  tl := &Timeline{Bucket: "month", Location: vladivostok, sums: make(map[int64]int), counts: make(map[int64]int)}
+  marks := []int{5, 2, 4}
+  for i, at := range []time.Time{
+    time.Date(2017, 10, 31, 14, 30, 0, 0, time.UTC), // November there
+    time.Date(2017, 10, 31, 13, 30, 0, 0, time.UTC),
+    time.Date(2017, 11, 20, 0, 0, 0, 0, time.UTC),
+  } {
+    tl.Add(&Visit{VisitedAt: at.Unix(), Mark: &marks[i]})
+  }
+
+  want := []TimelineBucketOut{
+    {"2017-10", time.Date(2017, 10, 1, 0, 0, 0, 0, vladivostok).Unix(), 1, 2},
+    {"2017-11", time.Date(2017, 11, 1, 0, 0, 0, 0, vladivostok).Unix(), 2, 4.5},
+  }
+  if got := tl.Out().Timeline; !reflect.DeepEqual(got, want) {
+    t.Errorf("%v, want %v", got, want)
+  }
+}
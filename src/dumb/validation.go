@@ -0,0 +1,167 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+  "github.com/valyala/fasthttp"
+  "golang.org/x/text/unicode/norm"
+)
+
+// POST bodies are checked against a rule table per entity before they are
+// decoded into User, Location or Visit. Rules see the raw JSON object, so a
+// missing field, an explicit null and a zero value are all told apart.
+// GET /schema publishes the same tables.
+
+type FieldRule struct {
+  Field      string    `json:"field"`
+  Type       string    `json:"type"`
+  Required   bool      `json:"required_on_create,omitempty"`
+  MaxLength  int       `json:"max_length,omitempty"`
+  Min        *int64    `json:"min,omitempty"`
+  Max        *int64    `json:"max,omitempty"`
+  Enum       []string  `json:"enum,omitempty"`
+}
+
+func bound(n int64) *int64 {
+  return &n
+}
+
+// Lengths are in code points of the NFC form, which is what gets stored.
+// The limits are the old "< 50" and "< 100" ones.
+var userRules = []FieldRule{
+  {Field: "id", Type: "int", Required: true, Min: bound(1)},
+  {Field: "email", Type: "string", Required: true, MaxLength: 99},
+  {Field: "first_name", Type: "string", Required: true, MaxLength: 49},
+  {Field: "last_name", Type: "string", Required: true, MaxLength: 49},
+  {Field: "gender", Type: "string", Required: true, Enum: []string{"m", "f"}},
+  {Field: "birth_date", Type: "int", Required: true},
+}
+
+var locationRules = []FieldRule{
+  {Field: "id", Type: "int", Required: true, Min: bound(1)},
+  {Field: "place", Type: "string", Required: true},
+  {Field: "country", Type: "string", Required: true, MaxLength: 49},
+  {Field: "city", Type: "string", Required: true, MaxLength: 49},
+  {Field: "distance", Type: "int", Required: true, Min: bound(0)},
+}
+
+var visitRules = []FieldRule{
+  {Field: "id", Type: "int", Required: true, Min: bound(1)},
+  {Field: "location", Type: "int", Required: true, Min: bound(1)},
+  {Field: "user", Type: "int", Required: true, Min: bound(1)},
+  {Field: "visited_at", Type: "int", Required: true},
+  {Field: "mark", Type: "int", Required: true, Min: bound(0), Max: bound(5)},
+}
+
+// ValidateBody decodes body as a JSON object and checks it against rules.
+// On create required fields must be present, updates only check what is sent.
+// The handlers then decode body a second time into their struct: that costs
+// a second parse per POST, but keeps the structs and their zero-value merging
+// as they are, and POSTs are rare next to GETs.
+func ValidateBody(body []byte, rules []FieldRule, create bool) *APIError {
+  var fields map[string]interface{}
+
+  d := json.NewDecoder(bytes.NewReader(body))
+  d.UseNumber()
+  err := d.Decode(&fields)
+  if err != nil || fields == nil {
+    return errInvalidJSON
+  }
+
+  for i := range rules {
+    r := &rules[i]
+    value, ok := fields[r.Field]
+    if !ok {
+      if create && r.Required {
+        return missingField(r.Field)
+      }
+      continue
+    }
+
+    apiErr := r.Check(value)
+    if apiErr != nil {
+      return apiErr
+    }
+  }
+
+  return nil
+}
+
+// Check validates one decoded JSON value, numbers are expected as json.Number.
+func (r *FieldRule) Check(value interface{}) *APIError {
+  if value == nil {
+    return nullField(r.Field)
+  }
+
+  switch r.Type {
+  case "string":
+    s, ok := value.(string)
+    if !ok {
+      return badField(r.Field, r.Field + " must be a string")
+    }
+
+    if r.MaxLength > 0 && utf8.RuneCountInString(norm.NFC.String(s)) > r.MaxLength {
+      return badField(r.Field, r.Field + " must be at most " + strconv.Itoa(r.MaxLength) + " characters")
+    }
+
+    if len(r.Enum) > 0 {
+      found := false
+      for _, e := range r.Enum {
+        if s == e {
+          found = true
+          break
+        }
+      }
+      if !found {
+        return badField(r.Field, r.Field + " must be one of " + strings.Join(r.Enum, ", "))
+      }
+    }
+  case "int":
+    num, ok := value.(json.Number)
+    if !ok {
+      return badField(r.Field, r.Field + " must be an integer")
+    }
+
+    n, err := num.Int64()
+    if err != nil {
+      return badField(r.Field, r.Field + " must be an integer")
+    }
+
+    if r.Min != nil && n < *r.Min {
+      return badField(r.Field, r.Field + " must be at least " + strconv.FormatInt(*r.Min, 10))
+    }
+
+    if r.Max != nil && n > *r.Max {
+      return badField(r.Field, r.Field + " must be at most " + strconv.FormatInt(*r.Max, 10))
+    }
+  }
+
+  return nil
+}
+
+// Strings are stored in NFC, so a name typed with combining marks ("и" plus
+// U+0306) equals the one typed with the precomposed "й".
+func normalizeUser(u *User) {
+  u.Email = norm.NFC.String(u.Email)
+  u.FirstName = norm.NFC.String(u.FirstName)
+  u.LastName = norm.NFC.String(u.LastName)
+}
+
+func normalizeLocation(l *Location) {
+  l.Place = norm.NFC.String(l.Place)
+  l.Country = norm.NFC.String(l.Country)
+  l.City = norm.NFC.String(l.City)
+}
+
+type SchemaOut struct {
+  Users      []FieldRule `json:"users"`
+  Locations  []FieldRule `json:"locations"`
+  Visits     []FieldRule `json:"visits"`
+}
+
+func SchemaHandlerGET(ctx *fasthttp.RequestCtx) (int, []byte) {
+  return 200, []byte(toJson(SchemaOut{userRules, locationRules, visitRules}))
+}
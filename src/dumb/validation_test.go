@@ -0,0 +1,97 @@
+package main
+
+import (
+  "strings"
+  "testing"
+  "unicode/utf8"
+)
+
+// и followed by a combining breve, й once composed
+const decomposedShortI = "\u0438\u0306"
+
+func TestValidateBodyRules(t *testing.T) {
+  visit := `"location": 1, "user": 1, "visited_at": 1000000000`
+
+  cases := []struct {
+    name   string
+    rules  []FieldRule
+    create bool
+    body   string
+    err    *APIError
+  }{
+    {"not an object", userRules, false, `[]`, errInvalidJSON},
+    {"null body", userRules, false, `null`, errInvalidJSON},
+    {"broken json", userRules, false, `{"id": `, errInvalidJSON},
+
+    {"missing on create", userRules, true, `{"id": 1, "first_name": "Иван"}`, missingField("email")},
+    {"allowed on update", userRules, false, `{"first_name": "Иван"}`, nil},
+    {"empty update", userRules, false, `{}`, nil},
+    {"complete create", visitRules, true, `{"id": 1, "mark": 5, ` + visit + `}`, nil},
+    {"explicit null", userRules, false, `{"first_name": null}`, nullField("first_name")},
+    {"null on create", visitRules, true, `{"id": 1, "mark": null, ` + visit + `}`, nullField("mark")},
+
+    {"negative mark", visitRules, false, `{"mark": -1}`, badField("mark", "mark must be at least 0")},
+    {"mark above 5", visitRules, false, `{"mark": 6}`, badField("mark", "mark must be at most 5")},
+    {"zero mark", visitRules, false, `{"mark": 0}`, nil},
+    {"negative distance", locationRules, false, `{"distance": -1}`, badField("distance", "distance must be at least 0")},
+    {"zero distance", locationRules, false, `{"distance": 0}`, nil},
+
+    {"fractional id", visitRules, true, `{"id": 1.5, "mark": 5, ` + visit + `}`, badField("id", "id must be an integer")},
+    {"string id", visitRules, true, `{"id": "1", "mark": 5, ` + visit + `}`, badField("id", "id must be an integer")},
+    {"zero id", userRules, true, `{"id": 0}`, badField("id", "id must be at least 1")},
+    {"number as string", userRules, false, `{"first_name": 1}`, badField("first_name", "first_name must be a string")},
+
+    {"gender outside enum", userRules, false, `{"gender": "x"}`, badField("gender", "gender must be one of m, f")},
+    {"gender case", userRules, false, `{"gender": "M"}`, badField("gender", "gender must be one of m, f")},
+    {"gender in enum", userRules, false, `{"gender": "f"}`, nil},
+  }
+
+  for _, c := range cases {
+    err := ValidateBody([]byte(c.body), c.rules, c.create)
+    if (err == nil) != (c.err == nil) || err != nil && *err != *c.err {
+      t.Errorf("%s: %v, want %v", c.name, err, c.err)
+    }
+  }
+}
+
+// Lengths count code points of the NFC form, not bytes: a Cyrillic letter
+// takes two bytes, a decomposed one four.
+func TestValidateBodyLength(t *testing.T) {
+  tooLong := badField("first_name", "first_name must be at most 49 characters")
+
+  cases := []struct {
+    name      string
+    firstName string
+    err       *APIError
+  }{
+    {"26 Cyrillic", strings.Repeat("ж", 26), nil},
+    {"49 Cyrillic", strings.Repeat("ж", 49), nil},
+    {"50 Cyrillic", strings.Repeat("ж", 50), tooLong},
+    {"49 decomposed", strings.Repeat(decomposedShortI, 49), nil},
+    {"50 decomposed", strings.Repeat(decomposedShortI, 50), tooLong},
+  }
+
+  for _, c := range cases {
+    body := `{"first_name": "` + c.firstName + `"}`
+    err := ValidateBody([]byte(body), userRules, false)
+    if (err == nil) != (c.err == nil) || err != nil && *err != *c.err {
+      t.Errorf("%s: %v, want %v", c.name, err, c.err)
+    }
+  }
+}
+
+// A name typed with combining marks is stored precomposed.
+func TestUsersPOSTStoresNFC(t *testing.T) {
+  resetTestData()
+  defer resetTestData()
+
+  body := `{"id": 1, "email": "a@mail.ru", "first_name": "Андре` + decomposedShortI + `", "last_name": "Петров", "gender": "m", "birth_date": 0}`
+  if status, out := testPOST(UsersHandlerPOST, -1, body); status != 200 {
+    t.Fatalf("POST /users/new: %d %s", status, out)
+  }
+
+  name := hlUsersData[1].FirstName
+  if name != "Андре\u0439" || utf8.RuneCountInString(name) != 6 {
+    t.Errorf("stored first_name %q, want %q", name, "Андре\u0439")
+  }
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+  "sort"
+  "time"
+  "github.com/valyala/fasthttp"
+)
+
+// One item per visit, a user visiting the location twice shows up twice.
+type LocationVisitorOut struct {
+  ID         int     `json:"id"`
+  FirstName  string  `json:"first_name"`
+  LastName   string  `json:"last_name"`
+  Gender     string  `json:"gender"`
+  Age        int     `json:"age"`
+  VisitedAt  int64   `json:"visited_at"`
+  Mark       int     `json:"mark"`
+  VisitID    int     `json:"-"`
+  BirthDate  int64   `json:"-"`
+}
+
+type LocationVisitorsType []LocationVisitorOut
+
+type LocationVisitorsOut struct {
+  Visitors   []LocationVisitorOut `json:"visitors"`
+}
+
+func (s LocationVisitorsType) Len() int {
+  return len(s)
+}
+
+func (s LocationVisitorsType) Swap(i, j int) {
+  s[i], s[j] = s[j], s[i]
+}
+
+func (s LocationVisitorsType) Less(i, j int) bool {
+  if s[i].VisitedAt != s[j].VisitedAt {
+    return s[i].VisitedAt < s[j].VisitedAt
+  }
+  return s[i].VisitID < s[j].VisitID
+}
+
+func LocationsHandlerGETVisitors(ctx *fasthttp.RequestCtx, lid int) (int, []byte) {
+  visitIDs := hlVisitsByLoc[lid]
+  visitors := make([]LocationVisitorOut, 0)
+
+  params := ctx.QueryArgs()
+
+  filter, apiErr := ParseLocationVisitsFilter(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  offset, limit, apiErr := queryPage(params)
+  if apiErr != nil {
+    return errorResponse(400, apiErr)
+  }
+
+  for _, vID := range visitIDs {
+    v := hlVisitsData[vID]
+    u := hlUsersData[v.User]
+
+    if filter.Match(v, &u) {
+      visitors = append(visitors, LocationVisitorOut{u.ID, u.FirstName, u.LastName, u.Gender, 0, v.VisitedAt, *v.Mark, v.ID, u.BirthDate})
+    }
+  }
+
+  sort.Sort(LocationVisitorsType(visitors))
+
+  from, to := pageBounds(len(visitors), offset, limit)
+  page := visitors[from:to]
+
+  // Only the page shown needs ages, taken at the time the age filters use
+  for i := range page {
+    page[i].Age = AgeAtIn(time.Unix(page[i].BirthDate, 0), filter.Now, AgeLocation)
+  }
+
+  return 200, []byte(toJson(LocationVisitorsOut{page}))
+}